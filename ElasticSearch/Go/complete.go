@@ -6,6 +6,7 @@ import (
 	"github.com/elastic/go-elasticsearch/v7"
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"log"
+	"os"
 	"strings"
 )
 
@@ -15,6 +16,11 @@ func main() {
 		log.Fatalf("Error creating the client: %s", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "seed" {
+		seedCommand(es, os.Args[2:])
+		return
+	}
+
 	// Create: Index Document
 	createDocument(es)
 
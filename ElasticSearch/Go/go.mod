@@ -2,4 +2,4 @@ module example
 
 go 1.21.5
 
-require github.com/elastic/go-elasticsearch/v7 v7.17.10 // indirect
+require github.com/elastic/go-elasticsearch/v7 v7.17.10
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/elastic/go-elasticsearch/v7"
+)
+
+const seedBatchSize = 1000
+
+// Load the dataset written by the PostgreSQL seed command
+// (go run . seed -out <dir> in PostgreSQL/Go) into the users and orders
+// indices, using each row's id as the document _id:
+//
+//	go run . seed -dir ../../dataset
+func seedCommand(es *elasticsearch.Client, args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	dir := flags.String("dir", "dataset", "directory containing users.jsonl and orders.jsonl")
+	flags.Parse(args)
+
+	n, err := bulkIndexJSONLines(es, "users", filepath.Join(*dir, "users.jsonl"))
+	if err != nil {
+		log.Fatalf("Error seeding users: %s", err)
+	}
+	fmt.Println("Seeded users:", n)
+
+	n, err = bulkIndexJSONLines(es, "orders", filepath.Join(*dir, "orders.jsonl"))
+	if err != nil {
+		log.Fatalf("Error seeding orders: %s", err)
+	}
+	fmt.Println("Seeded orders:", n)
+}
+
+func bulkIndexJSONLines(es *elasticsearch.Client, index, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	total, pending := 0, 0
+	var body bytes.Buffer
+	flush := func() error {
+		if pending == 0 {
+			return nil
+		}
+		res, err := es.Bulk(bytes.NewReader(body.Bytes()), es.Bulk.WithIndex(index))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.IsError() {
+			return fmt.Errorf("bulk index %s: %s", index, res.String())
+		}
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+			return err
+		}
+		if result.Errors {
+			return fmt.Errorf("bulk index %s: some documents failed", index)
+		}
+		total += pending
+		pending = 0
+		body.Reset()
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var row struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return total, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		fmt.Fprintf(&body, `{ "index": { "_id": "%d" } }`+"\n", row.ID)
+		body.Write(scanner.Bytes())
+		body.WriteByte('\n')
+		pending++
+		if pending == seedBatchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, err
+	}
+	if err := flush(); err != nil {
+		return total, err
+	}
+
+	res, err := es.Indices.Refresh(es.Indices.Refresh.WithIndex(index))
+	if err != nil {
+		return total, err
+	}
+	res.Body.Close()
+	return total, nil
+}
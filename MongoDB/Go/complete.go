@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -26,15 +28,23 @@ type Reaction struct {
 type ExampleDocument struct {
 	ID        primitive.ObjectID `bson:"_id,omitempty"`
 	Name      string             `bson:"name"`
-	Age       int                `bson:"age"`
+	Years     int                `bson:"years"`
 	Reactions []Reaction         `bson:"reactions,omitempty"`
+	// Reactions per emoji, maintained by Reactions
+	ReactionCounts map[string]int `bson:"reactionCounts,omitempty"`
 }
 
-var collection *mongo.Collection
+var (
+	client     *mongo.Client
+	collection *mongo.Collection
+	documents  *Repository[ExampleDocument]
+	reactions  *Reactions
+)
 
 func connect() {
 	clientOptions := options.Client().ApplyURI(uri).SetWriteConcern(writeconcern.New(writeconcern.WMajority()))
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	var err error
+	client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -45,107 +55,89 @@ func connect() {
 	fmt.Println("Connected successfully to MongoDB")
 
 	collection = client.Database(dbName).Collection(collectionName)
+	documents = NewRepository[ExampleDocument](collection).WithSchema(exampleSchema)
+	reactions = NewReactions(collection)
 }
 
 // CRUD Operations
-func createDocument(document ExampleDocument) {
-	_, err := collection.InsertOne(context.TODO(), document)
+func crudOperations(ctx context.Context) {
+	id, err := documents.Insert(ctx, ExampleDocument{Name: "Alice", Years: 25})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Document inserted")
-}
+	fmt.Println("Document inserted:", id)
 
-func createDocuments(documents []ExampleDocument) {
-	var docs []interface{}
-	for _, doc := range documents {
-		docs = append(docs, doc)
-	}
-	_, err := collection.InsertMany(context.TODO(), docs)
+	ids, err := documents.InsertMany(ctx, []ExampleDocument{
+		{Name: "Bob", Years: 30},
+		{Name: "Charlie", Years: 35},
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Documents inserted")
-}
+	fmt.Println("Documents inserted:", ids)
 
-func readDocument(filter bson.M) {
-	var result ExampleDocument
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
+	alice, err := documents.FindOne(ctx, bson.M{"name": "Alice"})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Read document:", result)
-}
+	fmt.Println("Read document:", alice)
 
-func readDocuments(filter bson.M) {
-	cursor, err := collection.Find(context.TODO(), filter)
+	all, err := documents.Find(ctx, bson.M{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	var results []ExampleDocument
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Read documents:", results)
-}
+	fmt.Println("Read documents:", all)
 
-func countDocuments(filter bson.M) {
-	count, err := collection.CountDocuments(context.TODO(), filter)
+	count, err := documents.Count(ctx, bson.M{"years": bson.M{"$gte": 25}})
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Count documents:", count)
-}
 
-func updateDocument(filter bson.M, update bson.M) {
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	_, err = documents.UpdateOne(ctx, bson.M{"name": "Alice"}, bson.M{"$set": bson.M{"years": 26}})
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Updated document")
-}
 
-func updateDocuments(filter bson.M, update bson.M) {
-	_, err := collection.UpdateMany(context.TODO(), filter, update)
+	res, err := documents.Update(ctx, bson.M{"years": bson.M{"$gt": 25}}, bson.M{"$set": bson.M{"years": 27}})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Updated documents")
-}
+	fmt.Println("Updated documents:", res.ModifiedCount)
 
-func replaceDocument(filter bson.M, replacement ExampleDocument) {
-	_, err := collection.ReplaceOne(context.TODO(), filter, replacement)
+	_, err = documents.Replace(ctx, bson.M{"name": "Bob"}, ExampleDocument{Name: "Bob", Years: 31})
 	if err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Replaced document")
-}
 
-func deleteDocument(filter bson.M) {
-	_, err := collection.DeleteOne(context.TODO(), filter)
-	if err != nil {
+	if err := documents.DeleteOne(ctx, bson.M{"name": "Charlie"}); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("Deleted document")
-}
 
-func deleteDocuments(filter bson.M) {
-	_, err := collection.DeleteMany(context.TODO(), filter)
+	deleted, err := documents.Delete(ctx, bson.M{"years": 27})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Deleted documents")
+	fmt.Println("Deleted documents:", deleted)
+
+	_, err = documents.FindOne(ctx, bson.M{"name": "Charlie"})
+	if errors.Is(err, ErrNotFound) {
+		fmt.Println("Charlie is gone:", err)
+	}
 }
 
 // Query Operators
 func queryOperators() {
-	filter := bson.M{
-		"age":       bson.M{"$gte": 18, "$lte": 30},
-		"name":      bson.M{"$in": bson.A{"Alice", "Bob"}},
-		"$or":       bson.A{bson.M{"age": bson.M{"$lt": 25}}, bson.M{"name": "Charlie"}},
-		"$and":      bson.A{bson.M{"age": bson.M{"$gt": 20}}, bson.M{"name": bson.M{"$ne": "Dave"}}},
-		"reactions": bson.M{"$exists": true},
-	}
+	filter := And(
+		docField.Years.Between(18, 30),
+		docField.Name.In("Alice", "Bob"),
+		Or(docField.Years.Lt(25), docField.Name.Eq("Charlie")),
+		And(docField.Years.Gt(20), docField.Name.Ne("Dave")),
+		docField.Reactions.Exists(true),
+	)
 	cursor, err := collection.Find(context.TODO(), filter)
 	if err != nil {
 		log.Fatal(err)
@@ -159,14 +151,17 @@ func queryOperators() {
 
 // Update Operators
 func updateOperators() {
-	filter := bson.M{"name": "Alice"}
-	update := bson.M{
-		"$set":    bson.M{"age": 26},
-		"$unset":  bson.M{"reactions": ""},
-		"$inc":    bson.M{"age": 1},
-		"$rename": bson.M{"age": "years"},
-	}
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	// $set, $inc and $max all touch years, which one update cannot do
+	update := NewUpdate(
+		Set(docField.Years, 26),
+		Unset(docField.Reactions),
+		Inc(docField.Years, 1),
+		Max(docField.Years, 30),
+	)
+	if _, err := update.Build(); err != nil {
+		fmt.Println("Update needs splitting:", err)
+	}
+	err := applyUpdates(context.TODO(), collection, docField.Name.Eq("Alice"), update.Split())
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -175,97 +170,206 @@ func updateOperators() {
 
 // Array Update Operators
 func arrayUpdateOperators() {
-	filter := bson.M{"name": "Alice"}
-	update := bson.M{
-		"$push":     bson.M{"reactions": Reaction{UserID: "user3", Emoji: "😃"}},
-		"$pull":     bson.M{"reactions": bson.M{"userId": "user2"}},
-		"$addToSet": bson.M{"reactions": Reaction{UserID: "user4", Emoji: "😎"}},
-		"$pop":      bson.M{"reactions": 1}, // removes the last item
-	}
-	_, err := collection.UpdateOne(context.TODO(), filter, update)
+	update := NewUpdate(
+		Push(docField.Reactions, Reaction{UserID: "user3", Emoji: "😃"}),
+		PullWhere(docField.Reactions, reactionField.UserID.Eq("user2")),
+		AddToSet(docField.Reactions, Reaction{UserID: "user4", Emoji: "😎"}),
+		PopLast(docField.Reactions), // removes the last item
+	)
+	err := applyUpdates(context.TODO(), collection, docField.Name.Eq("Alice"), update.Split())
 	if err != nil {
 		log.Fatal(err)
 	}
+	// The reactions were edited directly, so their counts are stale
+	if _, err := reactions.Recount(context.TODO(), docField.Name.Eq("Alice")); err != nil {
+		log.Fatal(err)
+	}
 	fmt.Println("Array update operators result")
 }
 
-// Aggregation
-func aggregation() {
-	pipeline := mongo.Pipeline{
-		bson.D{{"$match", bson.D{{"age", bson.D{{"$gte", 18}}}}}},
-		bson.D{{"$group", bson.D{{"_id", "$age"}, {"count", bson.D{{"$sum", 1}}}}}},
-		bson.D{{"$sort", bson.D{{"count", -1}}}},
-		bson.D{{"$limit", 5}},
-		bson.D{{"$skip", 1}},
-		bson.D{{"$project", bson.D{{"age", "$_id"}, {"count", 1}, {"_id", 0}}}},
-		bson.D{{"$unwind", "$reactions"}},
-		bson.D{{"$lookup", bson.D{{"from", "another_collection"}, {"localField", "name"}, {"foreignField", "name"}, {"as", "related_docs"}}}},
-		bson.D{{"$addFields", bson.D{{"additionalField", "new value"}}}},
-		bson.D{{"$replaceRoot", bson.D{{"newRoot", "$related_docs"}}}},
-	}
-	cursor, err := collection.Aggregate(context.TODO(), pipeline)
+// Reactions
+func reactionOperations(ctx context.Context) {
+	alice, err := documents.FindOne(ctx, docField.Name.Eq("Alice"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	var results []bson.M
-	if err := cursor.All(context.TODO(), &results); err != nil {
+
+	on, err := reactions.ToggleReaction(ctx, alice.ID, "user5", "👍")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Toggled reaction, now reacting:", on)
+
+	// Changes user5's reaction in place rather than adding a second one
+	if err := reactions.SetReaction(ctx, alice.ID, "user5", "🎉"); err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Aggregation results:", results)
+
+	page, err := reactions.ListReactors(ctx, alice.ID, "", 0, 10)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Reactors:", page.Reactions, "of", page.Total)
+
+	if err := reactions.RemoveReaction(ctx, alice.ID, "user5"); err != nil {
+		log.Fatal(err)
+	}
+	alice, err = documents.FindOne(ctx, docField.ID.Eq(alice.ID))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Reaction counts:", alice.ReactionCounts)
 }
 
-// Indexing
-func indexing() {
-	indexModel := mongo.IndexModel{
-		Keys: bson.D{{"name", 1}},
+// Aggregation
+func aggregation(ctx context.Context) {
+	// The stages as first written: $limit before $skip drops a document from
+	// the top five, $group and $project have already removed reactions and
+	// name, and $replaceRoot is given the related_docs array
+	draft := NewPipeline[ExampleDocument]().
+		Match(docField.Years.Gte(18)).
+		Group("$years", Accumulate("count", "$sum", 1)).
+		Sort(bson.D{{Key: "count", Value: -1}}).
+		Limit(5).
+		Skip(1).
+		Project(bson.D{{Key: "years", Value: "$_id"}, {Key: "count", Value: 1}, {Key: "_id", Value: 0}}).
+		Unwind("$reactions").
+		Lookup("another_collection", "name", "name", "related_docs").
+		AddFields(bson.D{{Key: "additionalField", Value: "new value"}}).
+		ReplaceRoot("$related_docs")
+	for _, w := range draft.Warnings() {
+		fmt.Println("Pipeline warning:", w)
+	}
+
+	// Ages by number of adults, second to fifth most common
+	type yearsCount struct {
+		Years int `bson:"years"`
+		Count int `bson:"count"`
+	}
+	byYears := NewPipeline[ExampleDocument]().
+		Match(docField.Years.Gte(18)).
+		Group("$years", Accumulate("count", "$sum", 1)).
+		Sort(bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}).
+		Skip(1).
+		Limit(4).
+		Project(bson.D{{Key: "years", Value: "$_id"}, {Key: "count", Value: 1}, {Key: "_id", Value: 0}})
+	counts, err := Aggregate[yearsCount](ctx, collection, byYears)
+	if err != nil {
+		log.Fatal(err)
 	}
-	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
+	fmt.Println("Aggregation results:", counts)
+
+	// Reactions with the matching documents from another_collection, and the
+	// emoji totals, in one pass
+	type reactionFacets struct {
+		Reactions []struct {
+			Name        string     `bson:"name"`
+			Reaction    Reaction   `bson:"reactions"`
+			RelatedDocs []bson.Raw `bson:"related_docs"`
+		} `bson:"reactions"`
+		Emoji []struct {
+			Emoji string `bson:"_id"`
+			Count int    `bson:"count"`
+		} `bson:"emoji"`
+	}
+	byReaction := NewPipeline[ExampleDocument]().
+		Unwind("$reactions").
+		Facet(
+			Facet{Name: "reactions", Build: func(p *Pipeline) {
+				p.Lookup("another_collection", "name", "name", "related_docs").
+					AddFields(bson.D{{Key: "additionalField", Value: "new value"}})
+			}},
+			Facet{Name: "emoji", Build: func(p *Pipeline) {
+				p.Group("$reactions.emoji", Accumulate("count", "$sum", 1)).
+					Sort(bson.D{{Key: "count", Value: -1}})
+			}},
+		)
+	facets, err := Aggregate[reactionFacets](ctx, collection, byReaction)
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Created index")
+	fmt.Println("Aggregation facets:", facets)
+}
 
-	indexModels := []mongo.IndexModel{
-		{Keys: bson.D{{"age", 1}}},
-		{Keys: bson.D{{"name", 1}, {"age", 1}}},
+// Indexing
+func indexing(ctx context.Context) {
+	// Declaring a hidden index lets the planner ignore it before it is dropped
+	declared := []CollectionIndexes{{
+		Collection: collectionName,
+		Indexes: append(append([]IndexSpec{}, managedIndexes[0].Indexes...),
+			IndexSpec{Keys: bson.D{{Key: "reactions.userId", Value: 1}}, Sparse: true, Hidden: true}),
+	}}
+	changes, err := SyncIndexes(ctx, collection.Database(), declared, SyncOptions{DryRun: true})
+	if err != nil {
+		log.Fatal(err)
 	}
-	_, err = collection.Indexes().CreateMany(context.TODO(), indexModels)
+	fmt.Println("Index changes (dry run):", changes)
+
+	changes, err = SyncIndexes(ctx, collection.Database(), declared, SyncOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Created indexes")
+	fmt.Println("Index changes:", changes)
 
-	cursor, err := collection.Indexes().List(context.TODO())
+	cursor, err := collection.Indexes().List(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
 	var indexes []bson.M
-	if err := cursor.All(context.TODO(), &indexes); err != nil {
+	if err := cursor.All(ctx, &indexes); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Println("List indexes:", indexes)
 
-	_, err = collection.Indexes().DropOne(context.TODO(), "name_1")
+	// Back to the indexes the service declares
+	changes, err = SyncIndexes(ctx, collection.Database(), managedIndexes[:1], SyncOptions{DropUnmanaged: true})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Dropped index")
+	fmt.Println("Index changes:", changes)
+}
+
+// Transactions
+func transactions(ctx context.Context) {
+	accounts := collection.Database().Collection("accounts")
+	for _, a := range []Account{{ID: "alice", Balance: 100}, {ID: "bob", Balance: 0}} {
+		_, err := accounts.ReplaceOne(ctx, bson.D{{Key: "_id", Value: a.ID}}, a, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if err := transfer(ctx, accounts, "alice", "bob", 40); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Transferred 40 from alice to bob")
 
-	_, err = collection.Indexes().DropAll(context.TODO())
+	err := transfer(ctx, accounts, "alice", "bob", 500)
+	if errors.Is(err, ErrInsufficientBalance) {
+		fmt.Println("Transfer rejected:", err)
+	}
+
+	balances, err := NewRepository[Account](accounts).Find(ctx, bson.D{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Println("Dropped all indexes")
+	fmt.Println("Balances:", balances)
 }
 
 // Miscellaneous Operations
 func miscellaneous() {
 	models := []mongo.WriteModel{
-		mongo.NewInsertOneModel().SetDocument(ExampleDocument{Name: "Eve", Age: 22}),
-		mongo.NewUpdateOneModel().SetFilter(bson.M{"name": "Alice"}).SetUpdate(bson.M{"$set": bson.M{"age": 29}}),
+		mongo.NewInsertOneModel().SetDocument(ExampleDocument{Name: "Eve", Years: 22}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"name": "Alice"}).SetUpdate(bson.M{"$set": bson.M{"years": 29}}),
 		mongo.NewDeleteOneModel().SetFilter(bson.M{"name": "Bob"}),
 	}
-	bulkResult, err := collection.BulkWrite(context.TODO(), models)
+	// All three writes or none
+	var bulkResult *mongo.BulkWriteResult
+	err := WithTransaction(context.TODO(), DefaultTxOptions(), func(sc mongo.SessionContext) error {
+		var err error
+		bulkResult, err = collection.BulkWrite(sc, models)
+		return err
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -280,7 +384,7 @@ func miscellaneous() {
 	updatedDoc := collection.FindOneAndUpdate(
 		context.TODO(),
 		bson.M{"name": "Eve"},
-		bson.M{"$set": bson.M{"age": 23}},
+		bson.M{"$set": bson.M{"years": 23}},
 		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	)
 	var updatedResult ExampleDocument
@@ -299,7 +403,7 @@ func miscellaneous() {
 	replacedDoc := collection.FindOneAndReplace(
 		context.TODO(),
 		bson.M{"name": "Alice"},
-		ExampleDocument{Name: "Alice", Age: 30},
+		ExampleDocument{Name: "Alice", Years: 30},
 	)
 	var replacedResult ExampleDocument
 	if err := replacedDoc.Decode(&replacedResult); err != nil {
@@ -311,20 +415,34 @@ func miscellaneous() {
 func main() {
 	connect()
 
+	// Sync the declared indexes and migrate before doing anything else,
+	// unless syncing indexes is the command being run
+	if len(os.Args) > 1 && os.Args[1] == "indexes" {
+		indexesCommand(os.Args[2:])
+		return
+	}
+	ctx := context.Background()
+	ensureIndexes(ctx)
+	runMigrations(ctx)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			exportCommand(os.Args[2:])
+		case "import":
+			importCommand(os.Args[2:])
+		case "seed":
+			seedCommand(os.Args[2:])
+		case "watch":
+			watchCommand(os.Args[2:])
+		default:
+			log.Fatalf("unknown command %q", os.Args[1])
+		}
+		return
+	}
+
 	// Run CRUD operations
-	createDocument(ExampleDocument{Name: "Alice", Age: 25})
-	createDocuments([]ExampleDocument{
-		{Name: "Bob", Age: 30},
-		{Name: "Charlie", Age: 35},
-	})
-	readDocument(bson.M{"name": "Alice"})
-	readDocuments(bson.M{})
-	countDocuments(bson.M{"age": bson.M{"$gte": 25}})
-	updateDocument(bson.M{"name": "Alice"}, bson.M{"$set": bson.M{"age": 26}})
-	updateDocuments(bson.M{"age": bson.M{"$gt": 25}}, bson.M{"$set": bson.M{"age": 27}})
-	replaceDocument(bson.M{"name": "Bob"}, ExampleDocument{Name: "Bob", Age: 31})
-	deleteDocument(bson.M{"name": "Charlie"})
-	deleteDocuments(bson.M{"age": 27})
+	crudOperations(ctx)
 
 	// Run Query Operators
 	queryOperators()
@@ -335,11 +453,17 @@ func main() {
 	// Run Array Update Operators
 	arrayUpdateOperators()
 
+	// Run Reactions
+	reactionOperations(ctx)
+
 	// Run Aggregation
-	aggregation()
+	aggregation(ctx)
 
 	// Run Indexing
-	indexing()
+	indexing(ctx)
+
+	// Run Transactions
+	transactions(ctx)
 
 	// Run Miscellaneous Operations
 	miscellaneous()
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A query filter rendered as an ordered bson.D. Filter marshals to BSON
+// itself, so it can be passed anywhere the driver takes a filter.
+type Filter struct {
+	elems bson.D
+}
+
+func (f Filter) BSON() bson.D {
+	if f.elems == nil {
+		return bson.D{}
+	}
+	return f.elems
+}
+
+func (f Filter) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(f.BSON())
+}
+
+// A document field of type V, addressed by its dotted bson path. Create
+// fields with FieldOf, which checks the path and type against the Go
+// struct, so operator values are type-checked by the compiler.
+type Field[V any] struct {
+	path string
+}
+
+func (f Field[V]) Path() string {
+	return f.path
+}
+
+func (f Field[V]) op(op string, value interface{}) Filter {
+	return Filter{bson.D{{Key: f.path, Value: bson.D{{Key: op, Value: value}}}}}
+}
+
+func (f Field[V]) Eq(v V) Filter {
+	return Filter{bson.D{{Key: f.path, Value: v}}}
+}
+
+func (f Field[V]) Ne(v V) Filter  { return f.op("$ne", v) }
+func (f Field[V]) Gt(v V) Filter  { return f.op("$gt", v) }
+func (f Field[V]) Gte(v V) Filter { return f.op("$gte", v) }
+func (f Field[V]) Lt(v V) Filter  { return f.op("$lt", v) }
+func (f Field[V]) Lte(v V) Filter { return f.op("$lte", v) }
+
+// lo <= field <= hi as a single condition
+func (f Field[V]) Between(lo, hi V) Filter {
+	return Filter{bson.D{{Key: f.path, Value: bson.D{{Key: "$gte", Value: lo}, {Key: "$lte", Value: hi}}}}}
+}
+
+func (f Field[V]) In(values ...V) Filter {
+	return f.op("$in", values)
+}
+
+func (f Field[V]) Nin(values ...V) Filter {
+	return f.op("$nin", values)
+}
+
+func (f Field[V]) Exists(exists bool) Filter {
+	return f.op("$exists", exists)
+}
+
+// Match a string field against a regular expression with options such as "i"
+func Regex(f Field[string], pattern, options string) Filter {
+	return f.op("$regex", primitive.Regex{Pattern: pattern, Options: options})
+}
+
+// An array element matching all filters; element fields are addressed
+// relative to the element, e.g. FieldOf[Reaction, string]("userId")
+func ElemMatch[E any](f Field[[]E], filters ...Filter) Filter {
+	return f.op("$elemMatch", And(filters...).BSON())
+}
+
+// All filters. Conditions on distinct fields are merged into one document;
+// repeated fields, which a document cannot hold twice, go into $and.
+func And(filters ...Filter) Filter {
+	var top, repeated bson.D
+	var overflow bson.A
+	seen := map[string]bool{}
+	var add func(e bson.E)
+	add = func(e bson.E) {
+		if e.Key == "$and" {
+			for _, item := range e.Value.(bson.A) {
+				for _, inner := range item.(bson.D) {
+					add(inner)
+				}
+			}
+			return
+		}
+		if seen[e.Key] {
+			overflow = append(overflow, bson.D{e})
+			return
+		}
+		seen[e.Key] = true
+		top = append(top, e)
+	}
+	for _, f := range filters {
+		for _, e := range f.elems {
+			add(e)
+		}
+	}
+	if len(overflow) > 0 {
+		repeated = bson.D{{Key: "$and", Value: overflow}}
+	}
+	return Filter{append(top, repeated...)}
+}
+
+func Or(filters ...Filter) Filter {
+	return logical("$or", filters)
+}
+
+func Nor(filters ...Filter) Filter {
+	return logical("$nor", filters)
+}
+
+func logical(op string, filters []Filter) Filter {
+	clauses := make(bson.A, len(filters))
+	for i, f := range filters {
+		clauses[i] = f.BSON()
+	}
+	return Filter{bson.D{{Key: op, Value: clauses}}}
+}
+
+// The field at path in documents decoded into T. Panics if path does not
+// name a bson field of T whose type is V, so a typo or type change fails
+// as soon as the program or its tests start.
+func FieldOf[T, V any](path string) Field[V] {
+	t, err := fieldType(reflect.TypeOf((*T)(nil)).Elem(), path)
+	if err == nil && t != reflect.TypeOf((*V)(nil)).Elem() {
+		err = fmt.Errorf("field %q is %s, not %s", path, t, reflect.TypeOf((*V)(nil)).Elem())
+	}
+	if err != nil {
+		panic(fmt.Sprintf("FieldOf[%s]: %v", reflect.TypeOf((*T)(nil)).Elem(), err))
+	}
+	return Field[V]{path: path}
+}
+
+// Resolve a dotted bson path through structs, pointers and slices
+func fieldType(t reflect.Type, path string) (reflect.Type, error) {
+	for _, name := range strings.Split(path, ".") {
+		for t.Kind() == reflect.Pointer || (t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8) {
+			if t.Kind() == reflect.Pointer {
+				t = t.Elem()
+				continue
+			}
+			// Arrays of documents: a path into the elements
+			if t.Elem().Kind() != reflect.Struct && t.Elem().Kind() != reflect.Pointer {
+				break
+			}
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("%q: %s has no field %q", path, t, name)
+		}
+		field, ok := bsonField(t, name)
+		if !ok {
+			return nil, fmt.Errorf("%q: %s has no bson field %q", path, t, name)
+		}
+		t = field.Type
+	}
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t, nil
+}
+
+// The struct field whose bson name is name; untagged fields use the
+// lower-cased Go name, as the driver does
+func bsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(f.Tag.Get("bson"), ",")
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = strings.ToLower(f.Name)
+		}
+		if tag == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// Fields of ExampleDocument and Reaction for filters
+var docField = struct {
+	ID        Field[primitive.ObjectID]
+	Name      Field[string]
+	Years     Field[int]
+	Reactions Field[[]Reaction]
+}{
+	ID:        FieldOf[ExampleDocument, primitive.ObjectID]("_id"),
+	Name:      FieldOf[ExampleDocument, string]("name"),
+	Years:     FieldOf[ExampleDocument, int]("years"),
+	Reactions: FieldOf[ExampleDocument, []Reaction]("reactions"),
+}
+
+var reactionField = struct {
+	UserID Field[string]
+	Emoji  Field[string]
+}{
+	UserID: FieldOf[Reaction, string]("userId"),
+	Emoji:  FieldOf[Reaction, string]("emoji"),
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type testAddress struct {
+	City string  `bson:"city"`
+	Zip  *string `bson:"zip"`
+}
+
+type testItem struct {
+	SKU string `bson:"sku"`
+}
+
+type testDoc struct {
+	Name    string       `bson:"name"`
+	Tags    []string     `bson:"tags"`
+	Address *testAddress `bson:"address"`
+	Items   []testItem   `bson:"items"`
+	Secret  string       `bson:"-"`
+	Plain   int
+	hidden  int
+}
+
+func TestFieldOf(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func()
+		panic bool
+	}{
+		{"top level", func() { FieldOf[testDoc, string]("name") }, false},
+		{"array", func() { FieldOf[testDoc, []string]("tags") }, false},
+		{"through pointer", func() { FieldOf[testDoc, string]("address.city") }, false},
+		{"pointer field", func() { FieldOf[testDoc, string]("address.zip") }, false},
+		{"into array elements", func() { FieldOf[testDoc, string]("items.sku") }, false},
+		{"untagged lower-cased", func() { FieldOf[testDoc, int]("plain") }, false},
+		{"unknown field", func() { FieldOf[testDoc, string]("nmae") }, true},
+		{"untagged by Go name", func() { FieldOf[testDoc, int]("Plain") }, true},
+		{"bson dash", func() { FieldOf[testDoc, string]("secret") }, true},
+		{"unexported", func() { FieldOf[testDoc, int]("hidden") }, true},
+		{"wrong type", func() { FieldOf[testDoc, int]("name") }, true},
+		{"wrong element type", func() { FieldOf[testDoc, []int]("tags") }, true},
+		{"into a scalar", func() { FieldOf[testDoc, string]("name.first") }, true},
+		{"into scalar array elements", func() { FieldOf[testDoc, string]("tags.first") }, true},
+		{"unknown nested", func() { FieldOf[testDoc, string]("address.street") }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panic {
+					t.Errorf("panic = %v, want panic %t", r, tt.panic)
+				}
+			}()
+			tt.build()
+		})
+	}
+}
+
+func TestAnd(t *testing.T) {
+	name := FieldOf[testDoc, string]("name")
+	city := FieldOf[testDoc, string]("address.city")
+	years := docField.Years
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bson.D
+	}{
+		{"empty", And(), bson.D{}},
+		{
+			"distinct fields merge",
+			And(name.Eq("a"), city.Eq("Oslo"), years.Gt(1)),
+			bson.D{
+				{Key: "name", Value: "a"},
+				{Key: "address.city", Value: "Oslo"},
+				{Key: "years", Value: bson.D{{Key: "$gt", Value: 1}}},
+			},
+		},
+		{
+			"repeated field overflows into $and",
+			And(years.Gt(1), name.Eq("a"), years.Lt(5)),
+			bson.D{
+				{Key: "years", Value: bson.D{{Key: "$gt", Value: 1}}},
+				{Key: "name", Value: "a"},
+				{Key: "$and", Value: bson.A{bson.D{{Key: "years", Value: bson.D{{Key: "$lt", Value: 5}}}}}},
+			},
+		},
+		{
+			"nested $and is flattened",
+			And(And(years.Gt(1), years.Lt(5)), name.Eq("a"), years.Ne(3)),
+			bson.D{
+				{Key: "years", Value: bson.D{{Key: "$gt", Value: 1}}},
+				{Key: "name", Value: "a"},
+				{Key: "$and", Value: bson.A{
+					bson.D{{Key: "years", Value: bson.D{{Key: "$lt", Value: 5}}}},
+					bson.D{{Key: "years", Value: bson.D{{Key: "$ne", Value: 3}}}},
+				}},
+			},
+		},
+		{
+			"logical operators are kept whole",
+			And(Or(name.Eq("a"), name.Eq("b")), years.Gte(18)),
+			bson.D{
+				{Key: "$or", Value: bson.A{bson.D{{Key: "name", Value: "a"}}, bson.D{{Key: "name", Value: "b"}}}},
+				{Key: "years", Value: bson.D{{Key: "$gte", Value: 18}}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.BSON(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("And() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
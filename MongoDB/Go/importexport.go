@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// File formats for Import and Export:
+//
+//	ndjson  one Extended JSON document per line
+//	json    a JSON array of Extended JSON documents
+//	csv     a header row of dotted field paths, then one row per document
+const (
+	FormatNDJSON = "ndjson"
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+)
+
+// The format a file name implies, ndjson unless it ends in .json or .csv
+func formatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".csv":
+		return FormatCSV
+	}
+	return FormatNDJSON
+}
+
+type ImportOptions struct {
+	Format string
+	// Documents per BulkWrite
+	BatchSize int
+	// Stop at the first failed document instead of skipping it
+	Ordered bool
+	// Replace the document with the same values in these fields, inserting
+	// it if there is none, instead of always inserting
+	UpsertKeys []string
+	// Receives one JSON line per failed document: its line, the error and
+	// the document if it could be read
+	ErrorReport io.Writer
+}
+
+type ImportResult struct {
+	Read     int64
+	Inserted int64
+	Upserted int64
+	Modified int64
+	Failed   int64
+}
+
+// A document that could not be read or written, as reported to
+// ImportOptions.ErrorReport
+type importFailure struct {
+	Line     int             `json:"line"`
+	Error    string          `json:"error"`
+	Document json.RawMessage `json:"document,omitempty"`
+}
+
+type importRecord struct {
+	line int
+	doc  bson.D
+}
+
+// A document the reader could not parse; reading carries on after it
+type recordError struct {
+	line int
+	err  error
+}
+
+func (e *recordError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+// Stream documents from r into coll in BulkWrite batches. In ordered mode
+// the import stops at the first document that cannot be read or written;
+// otherwise failed documents are counted, reported and skipped. Errors
+// other than per-document ones, such as a lost connection, always stop it.
+func Import(ctx context.Context, coll *mongo.Collection, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	var result ImportResult
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	next, err := newDocReader(opts.Format, r)
+	if err != nil {
+		return result, err
+	}
+	var report *json.Encoder
+	if opts.ErrorReport != nil {
+		report = json.NewEncoder(opts.ErrorReport)
+	}
+	fail := func(line int, err error, doc bson.D) error {
+		result.Failed++
+		if report == nil {
+			return nil
+		}
+		f := importFailure{Line: line, Error: err.Error()}
+		if doc != nil {
+			f.Document, _ = bson.MarshalExtJSON(doc, false, false)
+		}
+		return report.Encode(f)
+	}
+
+	var batch []importRecord
+	var models []mongo.WriteModel
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		res, err := coll.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(opts.Ordered))
+		if res != nil {
+			result.Inserted += res.InsertedCount
+			result.Upserted += res.UpsertedCount
+			result.Modified += res.ModifiedCount
+		}
+		var bwe mongo.BulkWriteException
+		if errors.As(err, &bwe) && bwe.WriteConcernError == nil {
+			for _, we := range bwe.WriteErrors {
+				rec := batch[we.Index]
+				if err := fail(rec.line, classifyError(we), rec.doc); err != nil {
+					return err
+				}
+			}
+			if opts.Ordered {
+				return fmt.Errorf("line %d: %w", batch[bwe.WriteErrors[0].Index].line, classifyError(bwe.WriteErrors[0]))
+			}
+			err = nil
+		}
+		batch, models = batch[:0], models[:0]
+		return classifyError(err)
+	}
+
+	for {
+		rec, err := next()
+		if err == io.EOF {
+			break
+		}
+		var re *recordError
+		if errors.As(err, &re) {
+			result.Read++
+			if err := fail(re.line, re.err, nil); err != nil {
+				return result, err
+			}
+			if opts.Ordered {
+				// Everything before the failed document is still written
+				if ferr := flush(); ferr != nil {
+					return result, ferr
+				}
+				return result, err
+			}
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.Read++
+
+		model, err := writeModel(rec.doc, opts.UpsertKeys)
+		if err != nil {
+			if err := fail(rec.line, err, rec.doc); err != nil {
+				return result, err
+			}
+			if opts.Ordered {
+				if ferr := flush(); ferr != nil {
+					return result, ferr
+				}
+				return result, fmt.Errorf("line %d: %w", rec.line, err)
+			}
+			continue
+		}
+		batch = append(batch, rec)
+		models = append(models, model)
+		if len(models) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return result, err
+			}
+		}
+	}
+	return result, flush()
+}
+
+func writeModel(doc bson.D, upsertKeys []string) (mongo.WriteModel, error) {
+	if len(upsertKeys) == 0 {
+		return mongo.NewInsertOneModel().SetDocument(doc), nil
+	}
+	filter := bson.D{}
+	for _, key := range upsertKeys {
+		v, ok := lookupPath(doc, strings.Split(key, "."))
+		if !ok {
+			return nil, fmt.Errorf("missing upsert key %q", key)
+		}
+		filter = append(filter, bson.E{Key: key, Value: v})
+	}
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true), nil
+}
+
+func lookupPath(doc bson.D, path []string) (interface{}, bool) {
+	for _, e := range doc {
+		if e.Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return e.Value, true
+		}
+		inner, ok := e.Value.(bson.D)
+		if !ok {
+			return nil, false
+		}
+		return lookupPath(inner, path[1:])
+	}
+	return nil, false
+}
+
+// A reader returns the next document, a *recordError for a document it
+// could not parse, or io.EOF
+func newDocReader(format string, r io.Reader) (func() (importRecord, error), error) {
+	switch format {
+	case FormatNDJSON, "":
+		return ndjsonReader(r), nil
+	case FormatJSON:
+		return jsonArrayReader(r)
+	case FormatCSV:
+		return csvReader(r)
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+// Maximum BSON document size, and so the longest line worth reading
+const maxDocumentSize = 16 << 20
+
+func ndjsonReader(r io.Reader) func() (importRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxDocumentSize)
+	line := 0
+	return func() (importRecord, error) {
+		for scanner.Scan() {
+			line++
+			text := bytes.TrimSpace(scanner.Bytes())
+			if len(text) == 0 {
+				continue
+			}
+			var doc bson.D
+			if err := bson.UnmarshalExtJSON(text, false, &doc); err != nil {
+				return importRecord{}, &recordError{line, err}
+			}
+			return importRecord{line, doc}, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return importRecord{}, err
+		}
+		return importRecord{}, io.EOF
+	}
+}
+
+// Documents are numbered from 1 in place of lines
+func jsonArrayReader(r io.Reader) (func() (importRecord, error), error) {
+	dec := json.NewDecoder(r)
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, errors.New("json import expects an array of documents")
+	}
+	n := 0
+	return func() (importRecord, error) {
+		if !dec.More() {
+			return importRecord{}, io.EOF
+		}
+		n++
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			// The array itself is broken, so nothing after this can be read
+			return importRecord{}, fmt.Errorf("document %d: %w", n, err)
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON(raw, false, &doc); err != nil {
+			return importRecord{}, &recordError{n, err}
+		}
+		return importRecord{n, doc}, nil
+	}, nil
+}
+
+// Fields are nested by their dotted header names. Blank values are left
+// out; integers, floats and true/false become numbers and booleans, and
+// everything else, including numbers with leading zeros, a string.
+func csvReader(r io.Reader) (func() (importRecord, error), error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+	paths := make([][]string, len(header))
+	for i, h := range header {
+		paths[i] = strings.Split(strings.TrimSpace(h), ".")
+	}
+	return func() (importRecord, error) {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return importRecord{}, io.EOF
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				return importRecord{}, &recordError{pe.Line, pe.Err}
+			}
+			return importRecord{}, err
+		}
+		line, _ := cr.FieldPos(0)
+		doc := bson.D{}
+		for i, value := range record {
+			if value == "" {
+				continue
+			}
+			doc = setPath(doc, paths[i], csvValue(value))
+		}
+		return importRecord{line, doc}, nil
+	}, nil
+}
+
+// Decimal and exponent notation. ParseFloat also accepts NaN, Inf, Infinity
+// and hex floats, which in a CSV file are text.
+var csvFloat = regexp.MustCompile(`^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)([eE][-+]?[0-9]+)?$`)
+
+func csvValue(s string) interface{} {
+	// Codes like 0150 would lose their leading zero as numbers
+	if digits := strings.TrimPrefix(s, "-"); len(digits) > 1 && digits[0] == '0' && digits[1] != '.' {
+		return s
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if i >= math.MinInt32 && i <= math.MaxInt32 {
+			return int32(i)
+		}
+		return i
+	}
+	if csvFloat.MatchString(s) {
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+	}
+	if b, err := strconv.ParseBool(s); err == nil && (s == "true" || s == "false") {
+		return b
+	}
+	return s
+}
+
+func setPath(doc bson.D, path []string, v interface{}) bson.D {
+	for i, e := range doc {
+		if e.Key == path[0] {
+			if len(path) == 1 {
+				doc[i].Value = v
+				return doc
+			}
+			inner, _ := e.Value.(bson.D)
+			doc[i].Value = setPath(inner, path[1:], v)
+			return doc
+		}
+	}
+	if len(path) == 1 {
+		return append(doc, bson.E{Key: path[0], Value: v})
+	}
+	return append(doc, bson.E{Key: path[0], Value: setPath(bson.D{}, path[1:], v)})
+}
+
+type ExportOptions struct {
+	Format string
+	Filter interface{}
+	// Fields to return; defaults to Fields when that is set
+	Projection interface{}
+	// Columns for CSV, as dotted paths; required for CSV
+	Fields []string
+	Sort   interface{}
+	Limit  int64
+	// Canonical rather than relaxed Extended JSON, preserving every
+	// numeric type at the cost of readability
+	Canonical bool
+}
+
+// Stream the documents matching opts.Filter to w and return how many
+// were written
+func Export(ctx context.Context, coll *mongo.Collection, w io.Writer, opts ExportOptions) (int64, error) {
+	if opts.Format == FormatCSV && len(opts.Fields) == 0 {
+		return 0, errors.New("csv export needs the fields to write")
+	}
+	filter := opts.Filter
+	if filter == nil {
+		filter = bson.D{}
+	}
+	findOpts := options.Find()
+	if opts.Projection != nil {
+		findOpts.SetProjection(opts.Projection)
+	} else if len(opts.Fields) > 0 {
+		projection := bson.D{}
+		for _, f := range opts.Fields {
+			projection = append(projection, bson.E{Key: f, Value: 1})
+		}
+		findOpts.SetProjection(projection)
+	}
+	if opts.Sort != nil {
+		findOpts.SetSort(opts.Sort)
+	}
+	if opts.Limit > 0 {
+		findOpts.SetLimit(opts.Limit)
+	}
+	cursor, err := coll.Find(ctx, filter, findOpts)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	defer cursor.Close(ctx)
+
+	bw := bufio.NewWriter(w)
+	var cw *csv.Writer
+	switch opts.Format {
+	case FormatNDJSON, "":
+	case FormatJSON:
+		bw.WriteString("[")
+	case FormatCSV:
+		cw = csv.NewWriter(bw)
+		if err := cw.Write(opts.Fields); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown export format %q", opts.Format)
+	}
+
+	var n int64
+	row := make([]string, len(opts.Fields))
+	for cursor.Next(ctx) {
+		if cw != nil {
+			for i, f := range opts.Fields {
+				row[i] = csvField(cursor.Current, f)
+			}
+			if err := cw.Write(row); err != nil {
+				return n, err
+			}
+		} else {
+			b, err := bson.MarshalExtJSON(cursor.Current, opts.Canonical, false)
+			if err != nil {
+				return n, err
+			}
+			if opts.Format == FormatJSON && n > 0 {
+				bw.WriteString(",")
+			}
+			bw.Write(b)
+			if opts.Format != FormatJSON {
+				bw.WriteString("\n")
+			}
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return n, classifyError(err)
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return n, err
+		}
+	}
+	if opts.Format == FormatJSON {
+		bw.WriteString("]\n")
+	}
+	return n, bw.Flush()
+}
+
+// A field as CSV text: blank if missing, plain text for strings, numbers,
+// booleans, ids and dates, and Extended JSON for anything else
+func csvField(doc bson.Raw, path string) string {
+	v, err := doc.LookupErr(strings.Split(path, ".")...)
+	if err != nil {
+		return ""
+	}
+	switch v.Type {
+	case bsontype.String:
+		return v.StringValue()
+	case bsontype.Int32:
+		return strconv.FormatInt(int64(v.Int32()), 10)
+	case bsontype.Int64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case bsontype.Double:
+		return strconv.FormatFloat(v.Double(), 'g', -1, 64)
+	case bsontype.Boolean:
+		return strconv.FormatBool(v.Boolean())
+	case bsontype.ObjectID:
+		return v.ObjectID().Hex()
+	case bsontype.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case bsontype.Null, bsontype.Undefined:
+		return ""
+	}
+	b, err := bson.MarshalExtJSON(bson.D{{Key: "v", Value: v}}, false, false)
+	if err != nil {
+		return v.String()
+	}
+	// Strip the {"v": ...} wrapper MarshalExtJSON needs
+	return string(b[len(`{"v":`) : len(b)-1])
+}
+
+// Import a file into a collection:
+//
+//	go run . import -collection users -file users.ndjson -upsert-key userId -errors failed.ndjson
+//	go run . import -collection orders -file orders.csv -batch 5000 -ordered
+func importCommand(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	collName := flags.String("collection", collectionName, "collection to import into")
+	file := flags.String("file", "", "file to import; - for standard input")
+	format := flags.String("format", "", "ndjson, json or csv; by default from the file extension")
+	batch := flags.Int("batch", 1000, "documents per bulk write")
+	ordered := flags.Bool("ordered", false, "stop at the first failed document")
+	upsertKey := flags.String("upsert-key", "", "comma-separated fields to replace documents by instead of inserting")
+	errorsFile := flags.String("errors", "", "file to write failed documents to, one JSON line each")
+	flags.Parse(args)
+
+	in := os.Stdin
+	if *file != "" && *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	opts := ImportOptions{Format: *format, BatchSize: *batch, Ordered: *ordered}
+	if opts.Format == "" {
+		opts.Format = formatOf(*file)
+	}
+	if *upsertKey != "" {
+		opts.UpsertKeys = strings.Split(*upsertKey, ",")
+	}
+	if *errorsFile != "" {
+		f, err := os.Create(*errorsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		opts.ErrorReport = f
+	}
+
+	result, err := Import(context.Background(), collection.Database().Collection(*collName), in, opts)
+	fmt.Printf("Imported: read %d, inserted %d, upserted %d, modified %d, failed %d\n",
+		result.Read, result.Inserted, result.Upserted, result.Modified, result.Failed)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Export a collection to a file:
+//
+//	go run . export -collection users -filter '{"age": {"$gte": 18}}' -out adults.ndjson
+//	go run . export -collection users -fields userId,name,email -out users.csv
+func exportCommand(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	collName := flags.String("collection", collectionName, "collection to export")
+	out := flags.String("out", "", "file to write; standard output if empty")
+	format := flags.String("format", "", "ndjson, json or csv; by default from the file extension")
+	filter := flags.String("filter", "", "query filter as Extended JSON")
+	projection := flags.String("projection", "", "projection as Extended JSON")
+	fields := flags.String("fields", "", "comma-separated fields to export; required for csv")
+	sortBy := flags.String("sort", "", "sort as Extended JSON")
+	limit := flags.Int64("limit", 0, "maximum documents to export")
+	canonical := flags.Bool("canonical", false, "write canonical Extended JSON")
+	flags.Parse(args)
+
+	opts := ExportOptions{Format: *format, Limit: *limit, Canonical: *canonical}
+	if opts.Format == "" {
+		opts.Format = formatOf(*out)
+	}
+	if *fields != "" {
+		opts.Fields = strings.Split(*fields, ",")
+	}
+	for _, p := range []struct {
+		name, value string
+		dst         *interface{}
+	}{{"filter", *filter, &opts.Filter}, {"projection", *projection, &opts.Projection}, {"sort", *sortBy, &opts.Sort}} {
+		if p.value == "" {
+			continue
+		}
+		var doc bson.D
+		if err := bson.UnmarshalExtJSON([]byte(p.value), false, &doc); err != nil {
+			log.Fatalf("-%s: %v", p.name, err)
+		}
+		*p.dst = doc
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := Export(context.Background(), collection.Database().Collection(*collName), w, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out != "" {
+		fmt.Println("Exported:", n)
+	}
+}
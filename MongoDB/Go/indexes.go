@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One index as the application wants it. Name defaults to the name the
+// server would generate from the keys, e.g. name_1_age_-1.
+type IndexSpec struct {
+	Name          string
+	Keys          bson.D
+	Unique        bool
+	Sparse        bool
+	Hidden        bool
+	PartialFilter Filter
+	// Documents expire this long after the time in the single key field
+	ExpireAfter time.Duration
+	Collation   *options.Collation
+}
+
+func (s IndexSpec) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	parts := make([]string, len(s.Keys))
+	for i, k := range s.Keys {
+		parts[i] = fmt.Sprintf("%s_%v", k.Key, k.Value)
+	}
+	return strings.Join(parts, "_")
+}
+
+func (s IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.name())
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.Sparse {
+		opts.SetSparse(true)
+	}
+	if s.Hidden {
+		opts.SetHidden(true)
+	}
+	if len(s.PartialFilter.BSON()) > 0 {
+		opts.SetPartialFilterExpression(s.PartialFilter.BSON())
+	}
+	if s.ExpireAfter > 0 {
+		opts.SetExpireAfterSeconds(int32(s.ExpireAfter / time.Second))
+	}
+	if s.Collation != nil {
+		opts.SetCollation(s.Collation)
+	}
+	return mongo.IndexModel{Keys: s.Keys, Options: opts}
+}
+
+// The indexes a collection should have
+type CollectionIndexes struct {
+	Collection string
+	Indexes    []IndexSpec
+}
+
+// Indexes managed by SyncIndexes at startup
+var managedIndexes = []CollectionIndexes{
+	{
+		Collection: collectionName,
+		Indexes: []IndexSpec{
+			// Also serves queries on name alone
+			{Keys: bson.D{{Key: "name", Value: 1}, {Key: "years", Value: 1}}},
+			{Keys: bson.D{{Key: "years", Value: 1}}},
+		},
+	},
+	{
+		Collection: "users",
+		Indexes: []IndexSpec{
+			{Keys: bson.D{{Key: "userId", Value: 1}}, Unique: true},
+			// Case-insensitive uniqueness for users that have an email
+			{
+				Keys:          bson.D{{Key: "email", Value: 1}},
+				Unique:        true,
+				PartialFilter: FieldOf[SeedUser, string]("email").Exists(true),
+				Collation:     &options.Collation{Locale: "en", Strength: 2},
+			},
+		},
+	},
+	{
+		Collection: "orders",
+		Indexes: []IndexSpec{
+			{Keys: bson.D{{Key: "orderId", Value: 1}}, Unique: true},
+			{Keys: bson.D{{Key: "userId", Value: 1}}},
+		},
+	},
+}
+
+type SyncOptions struct {
+	// Report the changes without making them
+	DryRun bool
+	// Drop indexes that are not declared; _id_ is never dropped
+	DropUnmanaged bool
+}
+
+// One change SyncIndexes made, or would make in a dry run
+type IndexChange struct {
+	Collection string
+	Index      string
+	// create, drop, recreate or modify
+	Action string
+	Reason string
+}
+
+func (c IndexChange) String() string {
+	s := fmt.Sprintf("%s %s.%s", c.Action, c.Collection, c.Index)
+	if c.Reason != "" {
+		s += " (" + c.Reason + ")"
+	}
+	return s
+}
+
+// An index as Indexes().List reports it
+type existingIndex struct {
+	Name               string             `bson:"name"`
+	Key                bson.D             `bson:"key"`
+	Unique             bool               `bson:"unique"`
+	Sparse             bool               `bson:"sparse"`
+	Hidden             bool               `bson:"hidden"`
+	PartialFilter      bson.D             `bson:"partialFilterExpression"`
+	ExpireAfterSeconds *int32             `bson:"expireAfterSeconds"`
+	Collation          *options.Collation `bson:"collation"`
+}
+
+// Bring each collection's indexes in line with the declarations. Missing
+// indexes are created; indexes whose hidden flag or TTL differ are changed
+// in place with collMod; indexes that differ in anything else are dropped
+// and created again. The changes are returned in the order they were made.
+func SyncIndexes(ctx context.Context, db *mongo.Database, declared []CollectionIndexes, opts SyncOptions) ([]IndexChange, error) {
+	var changes []IndexChange
+	for _, ci := range declared {
+		coll := db.Collection(ci.Collection)
+		planned, err := planIndexes(ctx, coll, ci.Indexes, opts.DropUnmanaged)
+		if err != nil {
+			return changes, fmt.Errorf("%s: %w", ci.Collection, err)
+		}
+		for _, p := range planned {
+			if !opts.DryRun {
+				if err := p.apply(ctx, coll); err != nil {
+					return changes, fmt.Errorf("%s: %w", p.change, err)
+				}
+			}
+			changes = append(changes, p.change)
+		}
+	}
+	return changes, nil
+}
+
+type plannedChange struct {
+	change IndexChange
+	spec   IndexSpec
+}
+
+func planIndexes(ctx context.Context, coll *mongo.Collection, specs []IndexSpec, dropUnmanaged bool) ([]plannedChange, error) {
+	cursor, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []existingIndex
+	if err := cursor.All(ctx, &list); err != nil {
+		return nil, err
+	}
+	existing := map[string]existingIndex{}
+	for _, idx := range list {
+		existing[idx.Name] = idx
+	}
+
+	var planned []plannedChange
+	managed := map[string]bool{}
+	for _, spec := range specs {
+		name := spec.name()
+		managed[name] = true
+		change := IndexChange{Collection: coll.Name(), Index: name}
+		have, ok := existing[name]
+		if !ok {
+			change.Action = "create"
+			planned = append(planned, plannedChange{change, spec})
+			continue
+		}
+		if reason := indexDiff(spec, have); reason != "" {
+			change.Action, change.Reason = "recreate", reason
+			planned = append(planned, plannedChange{change, spec})
+			continue
+		}
+		if reason := indexModDiff(spec, have); reason != "" {
+			change.Action, change.Reason = "modify", reason
+			planned = append(planned, plannedChange{change, spec})
+		}
+	}
+	if dropUnmanaged {
+		for _, idx := range list {
+			if idx.Name != "_id_" && !managed[idx.Name] {
+				change := IndexChange{Collection: coll.Name(), Index: idx.Name, Action: "drop", Reason: "not declared"}
+				planned = append(planned, plannedChange{change: change})
+			}
+		}
+	}
+	return planned, nil
+}
+
+func (p plannedChange) apply(ctx context.Context, coll *mongo.Collection) error {
+	switch p.change.Action {
+	case "create":
+		_, err := coll.Indexes().CreateOne(ctx, p.spec.model())
+		return err
+	case "drop":
+		_, err := coll.Indexes().DropOne(ctx, p.change.Index)
+		return err
+	case "recreate":
+		if _, err := coll.Indexes().DropOne(ctx, p.change.Index); err != nil {
+			return err
+		}
+		_, err := coll.Indexes().CreateOne(ctx, p.spec.model())
+		return err
+	case "modify":
+		index := bson.D{{Key: "name", Value: p.change.Index}, {Key: "hidden", Value: p.spec.Hidden}}
+		if p.spec.ExpireAfter > 0 {
+			index = append(index, bson.E{Key: "expireAfterSeconds", Value: int32(p.spec.ExpireAfter / time.Second)})
+		}
+		return coll.Database().RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: coll.Name()},
+			{Key: "index", Value: index},
+		}).Err()
+	}
+	return fmt.Errorf("unknown index action %q", p.change.Action)
+}
+
+// Differences that need the index rebuilt, or "" if there are none
+func indexDiff(spec IndexSpec, have existingIndex) string {
+	switch {
+	case !sameValue(spec.Keys, have.Key):
+		return fmt.Sprintf("keys %v, want %v", have.Key, spec.Keys)
+	case spec.Unique != have.Unique:
+		return fmt.Sprintf("unique %t, want %t", have.Unique, spec.Unique)
+	case spec.Sparse != have.Sparse:
+		return fmt.Sprintf("sparse %t, want %t", have.Sparse, spec.Sparse)
+	case !sameValue(spec.PartialFilter.BSON(), have.PartialFilter):
+		return fmt.Sprintf("partial filter %v, want %v", have.PartialFilter, spec.PartialFilter.BSON())
+	case (spec.ExpireAfter > 0) != (have.ExpireAfterSeconds != nil):
+		// collMod can change a TTL but not add or remove one
+		return "TTL added or removed"
+	case !sameCollation(spec.Collation, have.Collation):
+		return "collation differs"
+	}
+	return ""
+}
+
+// Differences collMod can change in place, or "" if there are none
+func indexModDiff(spec IndexSpec, have existingIndex) string {
+	var reasons []string
+	if spec.Hidden != have.Hidden {
+		reasons = append(reasons, fmt.Sprintf("hidden %t, want %t", have.Hidden, spec.Hidden))
+	}
+	if want := int32(spec.ExpireAfter / time.Second); have.ExpireAfterSeconds != nil && *have.ExpireAfterSeconds != want {
+		reasons = append(reasons, fmt.Sprintf("expireAfterSeconds %d, want %d", *have.ExpireAfterSeconds, want))
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// The server reports every collation option, so only the declared ones
+// are compared
+func sameCollation(want, have *options.Collation) bool {
+	if want == nil {
+		return have == nil || have.Locale == "simple"
+	}
+	if have == nil {
+		return false
+	}
+	w, h := reflect.ValueOf(*want), reflect.ValueOf(*have)
+	for i := 0; i < w.NumField(); i++ {
+		if !w.Field(i).IsZero() && w.Field(i).Interface() != h.Field(i).Interface() {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal documents and values, treating every numeric type as a number so
+// a declared int matches the int32 or double the server returns
+func sameValue(a, b interface{}) bool {
+	switch a := a.(type) {
+	case bson.D:
+		b, ok := b.(bson.D)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i].Key != b[i].Key || !sameValue(a[i].Value, b[i].Value) {
+				return false
+			}
+		}
+		return true
+	case bson.A:
+		b, ok := b.(bson.A)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !sameValue(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Create the declared indexes at startup. Nothing is dropped here; run the
+// indexes command with -drop-unmanaged for that.
+func ensureIndexes(ctx context.Context) {
+	changes, err := SyncIndexes(ctx, collection.Database(), managedIndexes, SyncOptions{})
+	if err != nil {
+		log.Fatalf("sync indexes: %v", err)
+	}
+	for _, c := range changes {
+		log.Println("Index:", c)
+	}
+}
+
+// Compare or sync the declared indexes:
+//
+//	go run . indexes -dry-run
+//	go run . indexes -drop-unmanaged
+func indexesCommand(args []string) {
+	flags := flag.NewFlagSet("indexes", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "print the changes without making them")
+	dropUnmanaged := flags.Bool("drop-unmanaged", false, "drop indexes that are not declared")
+	flags.Parse(args)
+
+	opts := SyncOptions{DryRun: *dryRun, DropUnmanaged: *dropUnmanaged}
+	changes, err := SyncIndexes(context.Background(), collection.Database(), managedIndexes, opts)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(changes) == 0 {
+		fmt.Println("Indexes are up to date")
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// Another process holds the migration lock for the collection
+	ErrMigrationLocked = errors.New("migrations are locked")
+	// A document is older than a migration that cannot upgrade it on read
+	ErrNeedsMigration = errors.New("document needs migration")
+)
+
+// Field holding the schema version a document was written at; documents
+// without it are at version 0
+const schemaVersionField = "schemaVersion"
+
+// One step in a collection's schema. The runner applies Update, a
+// document of update operators or an aggregation pipeline, to documents
+// below Version in batches, or calls Run once for changes an update
+// cannot express; either way the documents are then stamped with
+// Version. Upgrade performs the same change on one document as it is
+// read, so documents can also be upgraded lazily.
+type Migration struct {
+	Version int
+	Name    string
+	Update  interface{}
+	Run     func(ctx context.Context, coll *mongo.Collection) error
+	Upgrade func(doc bson.D) (bson.D, error)
+}
+
+// The migrations of one collection, in version order
+type Schema struct {
+	Collection string
+	Migrations []Migration
+}
+
+// The version documents are written at
+func (s *Schema) Version() int {
+	if len(s.Migrations) == 0 {
+		return 0
+	}
+	return s.Migrations[len(s.Migrations)-1].Version
+}
+
+func (s *Schema) validate() error {
+	for i, m := range s.Migrations {
+		if m.Version <= 0 || (i > 0 && m.Version <= s.Migrations[i-1].Version) {
+			return fmt.Errorf("%s: migration %q: versions must be positive and increasing", s.Collection, m.Name)
+		}
+		if m.Update != nil && m.Run != nil {
+			return fmt.Errorf("%s: migration %q: set Update or Run, not both", s.Collection, m.Name)
+		}
+	}
+	return nil
+}
+
+// Bring a document read at any earlier version up to the current one
+func (s *Schema) Upgrade(doc bson.D) (bson.D, error) {
+	from := docVersion(doc)
+	for _, m := range s.Migrations {
+		if m.Version <= from {
+			continue
+		}
+		if m.Upgrade == nil {
+			return nil, fmt.Errorf("%w: %s version %d, migration %d (%s) has no upgrade on read",
+				ErrNeedsMigration, s.Collection, from, m.Version, m.Name)
+		}
+		var err error
+		if doc, err = m.Upgrade(doc); err != nil {
+			return nil, fmt.Errorf("%s: upgrade to version %d: %w", s.Collection, m.Version, err)
+		}
+	}
+	return setPath(doc, []string{schemaVersionField}, int32(s.Version())), nil
+}
+
+func docVersion(doc bson.D) int {
+	v, _ := lookupPath(doc, []string{schemaVersionField})
+	n, _ := number(v)
+	return int(n)
+}
+
+// Documents whose version is below v, including those without a version
+func belowVersion(v int) bson.D {
+	return bson.D{{Key: schemaVersionField, Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: v}}}}}}
+}
+
+// The update with schemaVersion set to v added to it
+func withVersion(update interface{}, v int) (interface{}, error) {
+	set := bson.E{Key: schemaVersionField, Value: int32(v)}
+	switch u := update.(type) {
+	case nil:
+		return bson.D{{Key: "$set", Value: bson.D{set}}}, nil
+	case mongo.Pipeline:
+		return append(append(mongo.Pipeline{}, u...), bson.D{{Key: "$set", Value: bson.D{set}}}), nil
+	case bson.D:
+		out := append(bson.D{}, u...)
+		for i, e := range out {
+			if e.Key == "$set" {
+				fields, ok := e.Value.(bson.D)
+				if !ok {
+					return nil, errors.New("migration update: $set must be a bson.D")
+				}
+				out[i].Value = append(append(bson.D{}, fields...), set)
+				return out, nil
+			}
+		}
+		return append(out, bson.E{Key: "$set", Value: bson.D{set}}), nil
+	}
+	return nil, fmt.Errorf("migration update must be a bson.D or mongo.Pipeline, not %T", update)
+}
+
+// A migration as recorded in the migrations collection
+type MigrationRecord struct {
+	ID         string     `bson:"_id"`
+	Collection string     `bson:"collection"`
+	Version    int        `bson:"version"`
+	Name       string     `bson:"name"`
+	StartedAt  time.Time  `bson:"startedAt"`
+	FinishedAt *time.Time `bson:"finishedAt,omitempty"`
+	Documents  int64      `bson:"documents"`
+}
+
+// Applies schemas, recording each migration in the migrations collection
+// and holding a lock document in migration_locks so that only one process
+// migrates a collection at a time
+type Migrator struct {
+	db *mongo.Database
+
+	// Identifies this process in the lock document
+	Owner string
+	// A lock not renewed for this long is taken over; it is renewed
+	// every third of it while migrations run
+	LockTTL time.Duration
+	// Documents per updateMany
+	BatchSize int
+	// Called after each batch
+	Progress func(m Migration, done, total int64)
+}
+
+func NewMigrator(db *mongo.Database) *Migrator {
+	host, _ := os.Hostname()
+	return &Migrator{
+		db:        db,
+		Owner:     fmt.Sprintf("%s:%d", host, os.Getpid()),
+		LockTTL:   time.Minute,
+		BatchSize: 1000,
+	}
+}
+
+// Apply the schema's migrations that have not finished yet, in order, and
+// return the ones applied. A migration interrupted part way is run again
+// from where it stopped, since finished documents carry its version.
+func (m *Migrator) Migrate(ctx context.Context, s *Schema) ([]MigrationRecord, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	ctx, release, err := m.lock(ctx, s.Collection)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	records := m.db.Collection("migrations")
+	cursor, err := records.Find(ctx, bson.D{{Key: "collection", Value: s.Collection}})
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	var done []MigrationRecord
+	if err := cursor.All(ctx, &done); err != nil {
+		return nil, classifyError(err)
+	}
+	finished := map[int]MigrationRecord{}
+	for _, r := range done {
+		if r.FinishedAt != nil {
+			finished[r.Version] = r
+		}
+	}
+
+	var applied []MigrationRecord
+	for _, mig := range s.Migrations {
+		if r, ok := finished[mig.Version]; ok {
+			if r.Name != mig.Name {
+				return applied, fmt.Errorf("%s: version %d was applied as %q, not %q", s.Collection, mig.Version, r.Name, mig.Name)
+			}
+			continue
+		}
+		rec := MigrationRecord{
+			ID:         fmt.Sprintf("%s/%d", s.Collection, mig.Version),
+			Collection: s.Collection,
+			Version:    mig.Version,
+			Name:       mig.Name,
+			StartedAt:  time.Now(),
+		}
+		if _, err := records.ReplaceOne(ctx, bson.D{{Key: "_id", Value: rec.ID}}, rec, options.Replace().SetUpsert(true)); err != nil {
+			return applied, classifyError(err)
+		}
+		n, err := m.apply(ctx, m.db.Collection(s.Collection), mig)
+		if ctx.Err() != nil {
+			// Report why the lock's context ended, such as losing the lock
+			err = context.Cause(ctx)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("%s: migration %d (%s): %w", s.Collection, mig.Version, mig.Name, err)
+		}
+		now := time.Now()
+		rec.FinishedAt, rec.Documents = &now, n
+		if _, err := records.ReplaceOne(ctx, bson.D{{Key: "_id", Value: rec.ID}}, rec); err != nil {
+			return applied, classifyError(err)
+		}
+		applied = append(applied, rec)
+	}
+	return applied, nil
+}
+
+// Run one migration and return how many documents it changed
+func (m *Migrator) apply(ctx context.Context, coll *mongo.Collection, mig Migration) (int64, error) {
+	if mig.Run != nil {
+		if err := mig.Run(ctx, coll); err != nil {
+			return 0, err
+		}
+	}
+	update, err := withVersion(mig.Update, mig.Version)
+	if err != nil {
+		return 0, err
+	}
+	below := belowVersion(mig.Version)
+	total, err := coll.CountDocuments(ctx, below)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+
+	// Batches of _ids rather than one updateMany, so progress is visible,
+	// each batch is short, and an interrupted run resumes where it stopped
+	var n int64
+	findOpts := options.Find().
+		SetProjection(bson.D{{Key: "_id", Value: 1}}).
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(int64(m.BatchSize))
+	for {
+		cursor, err := coll.Find(ctx, below, findOpts)
+		if err != nil {
+			return n, classifyError(err)
+		}
+		var batch []struct {
+			ID interface{} `bson:"_id"`
+		}
+		if err := cursor.All(ctx, &batch); err != nil {
+			return n, classifyError(err)
+		}
+		if len(batch) == 0 {
+			return n, nil
+		}
+		ids := make(bson.A, len(batch))
+		for i, doc := range batch {
+			ids[i] = doc.ID
+		}
+		filter := append(bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}, below...)
+		res, err := coll.UpdateMany(ctx, filter, update)
+		if err != nil {
+			return n, classifyError(err)
+		}
+		n += res.MatchedCount
+		if m.Progress != nil {
+			m.Progress(mig, n, max(total, n))
+		}
+	}
+}
+
+type migrationLock struct {
+	ID        string    `bson:"_id"`
+	Owner     string    `bson:"owner"`
+	ExpiresAt time.Time `bson:"expiresAt"`
+}
+
+// Take the collection's lock document and keep renewing it. The returned
+// context is cancelled if the lock is lost, which stops the migrations.
+func (m *Migrator) lock(ctx context.Context, name string) (context.Context, func(), error) {
+	locks := m.db.Collection("migration_locks")
+	now := time.Now()
+	// Matches only a free or expired lock; when another process holds it
+	// the upsert collides with its _id
+	_, err := locks.UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: name}, {Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: now}}}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: m.Owner}, {Key: "expiresAt", Value: now.Add(m.LockTTL)}}}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		var held migrationLock
+		if err := locks.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&held); err == nil {
+			return nil, nil, fmt.Errorf("%w: %s is held by %s until %s", ErrMigrationLocked, name, held.Owner, held.ExpiresAt.Format(time.RFC3339))
+		}
+		return nil, nil, fmt.Errorf("%w: %s", ErrMigrationLocked, name)
+	}
+	if err != nil {
+		return nil, nil, classifyError(err)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	owned := bson.D{{Key: "_id", Value: name}, {Key: "owner", Value: m.Owner}}
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(m.LockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			res, err := locks.UpdateOne(ctx, owned, bson.D{{Key: "$set", Value: bson.D{{Key: "expiresAt", Value: time.Now().Add(m.LockTTL)}}}})
+			if err == nil && res.MatchedCount == 0 {
+				cancel(fmt.Errorf("%w: lost the lock on %s", ErrMigrationLocked, name))
+				return
+			}
+		}
+	}()
+	release := func() {
+		close(stop)
+		cancel(nil)
+		if _, err := locks.DeleteOne(context.Background(), owned); err != nil {
+			log.Printf("Release migration lock %s: %v\n", name, err)
+		}
+	}
+	return ctx, release, nil
+}
+
+// Schema of example_collection
+var exampleSchema = &Schema{
+	Collection: collectionName,
+	Migrations: []Migration{
+		{
+			Version: 1,
+			Name:    "rename age to years",
+			Update:  bson.D{{Key: "$rename", Value: bson.D{{Key: "age", Value: "years"}}}},
+			// Like $rename, replaces any years field already there
+			Upgrade: func(doc bson.D) (bson.D, error) {
+				age, ok := lookupPath(doc, []string{"age"})
+				if !ok {
+					return doc, nil
+				}
+				out := bson.D{}
+				for _, e := range doc {
+					if e.Key != "age" && e.Key != "years" {
+						out = append(out, e)
+					}
+				}
+				return append(out, bson.E{Key: "years", Value: age}), nil
+			},
+		},
+		{
+			Version: 2,
+			Name:    "backfill reaction counts",
+			Update:  mongo.Pipeline{bson.D{{Key: "$set", Value: bson.D{{Key: "reactionCounts", Value: reactionCountsExpr()}}}}},
+			Upgrade: func(doc bson.D) (bson.D, error) {
+				counts := bson.D{}
+				list, _ := lookupPath(doc, []string{"reactions"})
+				items, _ := list.(bson.A)
+				for _, item := range items {
+					r, _ := item.(bson.D)
+					emoji, _ := lookupPath(r, []string{"emoji"})
+					if s, ok := emoji.(string); ok {
+						n, _ := lookupPath(counts, []string{s})
+						c, _ := n.(int32)
+						counts = setPath(counts, []string{s}, c+1)
+					}
+				}
+				return setPath(doc, []string{"reactionCounts"}, counts), nil
+			},
+		},
+	},
+}
+
+// Apply pending migrations at startup. A process that finds another one
+// migrating carries on: documents it reads are upgraded as they are read.
+func runMigrations(ctx context.Context) {
+	migrator := NewMigrator(collection.Database())
+	migrator.Progress = func(m Migration, done, total int64) {
+		log.Printf("Migration %d (%s): %d/%d documents\n", m.Version, m.Name, done, total)
+	}
+	applied, err := migrator.Migrate(ctx, exampleSchema)
+	if errors.Is(err, ErrMigrationLocked) {
+		log.Println("Skipping migrations:", err)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range applied {
+		log.Printf("Applied migration %d (%s) to %d documents\n", r.Version, r.Name, r.Documents)
+	}
+}
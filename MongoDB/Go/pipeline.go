@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type fieldKind int
+
+const (
+	kindUnknown fieldKind = iota
+	kindScalar
+	kindDocument
+	kindArray
+)
+
+// Builds an aggregation pipeline while tracking which top-level fields the
+// documents have after each stage. References to fields that no earlier
+// stage produced, and stage orders that are probably mistakes, are
+// collected as warnings; the pipeline is still built as written.
+type Pipeline struct {
+	stages   mongo.Pipeline
+	fields   map[string]fieldKind
+	open     bool              // the document shape is no longer known
+	last     string            // stage being added
+	removed  map[string]string // field -> stage that removed it
+	warnings []string
+}
+
+// A pipeline over documents decoded into T, starting with T's bson fields
+func NewPipeline[T any]() *Pipeline {
+	p := &Pipeline{fields: map[string]fieldKind{"_id": kindUnknown}}
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		p.open = true
+		return p
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("bson"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		p.fields[name] = kindOf(f.Type)
+	}
+	return p
+}
+
+func kindOf(t reflect.Type) fieldKind {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8, t.Kind() == reflect.Array:
+		return kindArray
+	case t.Kind() == reflect.Struct && t.PkgPath() != "time", t.Kind() == reflect.Map:
+		return kindDocument
+	}
+	return kindScalar
+}
+
+func (p *Pipeline) Stages() mongo.Pipeline {
+	return p.stages
+}
+
+func (p *Pipeline) Warnings() []string {
+	return p.warnings
+}
+
+func (p *Pipeline) warn(format string, args ...interface{}) {
+	p.warnings = append(p.warnings, fmt.Sprintf("stage %d (%s): ", len(p.stages)+1, p.last)+fmt.Sprintf(format, args...))
+}
+
+// Name the stage being added, for warnings raised while checking it
+func (p *Pipeline) begin(name string) {
+	p.last = name
+}
+
+func (p *Pipeline) add(name string, spec interface{}) *Pipeline {
+	p.stages = append(p.stages, bson.D{{Key: name, Value: spec}})
+	return p
+}
+
+func (p *Pipeline) previous() string {
+	if len(p.stages) == 0 {
+		return ""
+	}
+	return p.stages[len(p.stages)-1][0].Key
+}
+
+// Warn about a reference to a top-level field the documents do not have
+func (p *Pipeline) checkField(path string) {
+	if p.open {
+		return
+	}
+	top, _, _ := strings.Cut(path, ".")
+	if _, ok := p.fields[top]; ok {
+		return
+	}
+	if by, ok := p.removed[top]; ok {
+		p.warn("field %q was removed by %s", top, by)
+	} else {
+		p.warn("field %q does not exist at this point", top)
+	}
+}
+
+// Replace the tracked fields after a stage that reshapes documents,
+// remembering which fields it removed
+func (p *Pipeline) reshape(fields map[string]fieldKind, open bool) {
+	if p.removed == nil {
+		p.removed = map[string]string{}
+	}
+	for name := range p.fields {
+		if _, ok := fields[name]; !ok {
+			p.removed[name] = fmt.Sprintf("stage %d (%s)", len(p.stages), p.last)
+		}
+	}
+	for name := range fields {
+		delete(p.removed, name)
+	}
+	p.fields, p.open = fields, open
+}
+
+// Check every "$field" path inside an expression
+func (p *Pipeline) checkExpr(expr interface{}) {
+	switch v := expr.(type) {
+	case string:
+		if strings.HasPrefix(v, "$") && !strings.HasPrefix(v, "$$") {
+			p.checkField(v[1:])
+		}
+	case bson.D:
+		for _, e := range v {
+			p.checkExpr(e.Value)
+		}
+	case bson.M:
+		for _, value := range v {
+			p.checkExpr(value)
+		}
+	case bson.A:
+		for _, item := range v {
+			p.checkExpr(item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			p.checkExpr(item)
+		}
+	}
+}
+
+// Check the field names a query filter matches on
+func (p *Pipeline) checkFilter(filter bson.D) {
+	for _, e := range filter {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			if clauses, ok := e.Value.(bson.A); ok {
+				for _, c := range clauses {
+					if d, ok := c.(bson.D); ok {
+						p.checkFilter(d)
+					}
+				}
+			}
+		case "$expr":
+			p.checkExpr(e.Value)
+		default:
+			if !strings.HasPrefix(e.Key, "$") {
+				p.checkField(e.Key)
+			}
+		}
+	}
+}
+
+func (p *Pipeline) Match(f Filter) *Pipeline {
+	p.begin("$match")
+	p.checkFilter(f.BSON())
+	return p.add("$match", f.BSON())
+}
+
+// An accumulator in a $group stage, e.g. Accumulate("count", "$sum", 1)
+type Accumulator struct {
+	Name string
+	Op   string
+	Expr interface{}
+}
+
+func Accumulate(name, op string, expr interface{}) Accumulator {
+	return Accumulator{Name: name, Op: op, Expr: expr}
+}
+
+// Group by id; afterwards the documents hold only _id and the accumulators
+func (p *Pipeline) Group(id interface{}, accumulators ...Accumulator) *Pipeline {
+	p.begin("$group")
+	p.checkExpr(id)
+	spec := bson.D{{Key: "_id", Value: id}}
+	fields := map[string]fieldKind{"_id": kindUnknown}
+	for _, a := range accumulators {
+		p.checkExpr(a.Expr)
+		spec = append(spec, bson.E{Key: a.Name, Value: bson.D{{Key: a.Op, Value: a.Expr}}})
+		kind := kindScalar
+		if a.Op == "$push" || a.Op == "$addToSet" {
+			kind = kindArray
+		}
+		fields[a.Name] = kind
+	}
+	p.add("$group", spec)
+	p.reshape(fields, false)
+	return p
+}
+
+func (p *Pipeline) Sort(keys bson.D) *Pipeline {
+	p.begin("$sort")
+	if p.previous() == "$limit" {
+		p.warn("$sort after $limit only orders the documents the limit kept")
+	}
+	for _, k := range keys {
+		p.checkField(k.Key)
+	}
+	return p.add("$sort", keys)
+}
+
+func (p *Pipeline) Limit(n int64) *Pipeline {
+	p.begin("$limit")
+	if n <= 0 {
+		p.warn("limit must be positive, got %d", n)
+	}
+	return p.add("$limit", n)
+}
+
+func (p *Pipeline) Skip(n int64) *Pipeline {
+	p.begin("$skip")
+	if p.previous() == "$limit" {
+		p.warn("$skip after $limit returns fewer documents than the limit; skip first for pagination")
+	}
+	if n < 0 {
+		p.warn("skip must not be negative, got %d", n)
+	}
+	return p.add("$skip", n)
+}
+
+// Include or exclude fields. An inclusion projection keeps only the listed
+// and computed fields (and _id unless excluded); an exclusion projection
+// removes the listed fields.
+func (p *Pipeline) Project(spec bson.D) *Pipeline {
+	p.begin("$project")
+	exclusion := true
+	for _, e := range spec {
+		if e.Key != "_id" && !isExclusion(e.Value) {
+			exclusion = false
+		}
+	}
+
+	if exclusion {
+		fields := map[string]fieldKind{}
+		for name, kind := range p.fields {
+			fields[name] = kind
+		}
+		for _, e := range spec {
+			p.checkField(e.Key)
+			delete(fields, e.Key)
+		}
+		p.add("$project", spec)
+		p.reshape(fields, p.open)
+		return p
+	}
+
+	fields := map[string]fieldKind{"_id": kindUnknown}
+	for _, e := range spec {
+		top, _, _ := strings.Cut(e.Key, ".")
+		switch {
+		case isExclusion(e.Value):
+			delete(fields, top)
+		case isInclusion(e.Value):
+			p.checkField(e.Key)
+			fields[top] = p.fields[top]
+		default:
+			p.checkExpr(e.Value)
+			fields[top] = kindUnknown
+		}
+	}
+	p.add("$project", spec)
+	p.reshape(fields, false)
+	return p
+}
+
+func isExclusion(v interface{}) bool {
+	switch v := v.(type) {
+	case int:
+		return v == 0
+	case int32:
+		return v == 0
+	case int64:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return false
+}
+
+func isInclusion(v interface{}) bool {
+	switch v := v.(type) {
+	case int, int32, int64:
+		return !isExclusion(v)
+	case bool:
+		return v
+	}
+	return false
+}
+
+// Unwind an array field, given as "$field"
+func (p *Pipeline) Unwind(path string) *Pipeline {
+	p.begin("$unwind")
+	if !strings.HasPrefix(path, "$") {
+		p.warn("unwind path %q must start with $", path)
+	} else {
+		p.checkField(path[1:])
+		if kind, ok := p.fields[path[1:]]; ok && kind != kindArray && kind != kindUnknown {
+			p.warn("field %q is not an array", path[1:])
+		}
+		if _, ok := p.fields[path[1:]]; ok {
+			p.fields[path[1:]] = kindUnknown
+		}
+	}
+	return p.add("$unwind", path)
+}
+
+// Join documents from another collection into the array field as
+func (p *Pipeline) Lookup(from, localField, foreignField, as string) *Pipeline {
+	p.begin("$lookup")
+	p.checkField(localField)
+	p.fields[as] = kindArray
+	return p.add("$lookup", bson.D{
+		{Key: "from", Value: from},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+func (p *Pipeline) AddFields(spec bson.D) *Pipeline {
+	p.begin("$addFields")
+	for _, e := range spec {
+		p.checkExpr(e.Value)
+	}
+	for _, e := range spec {
+		top, _, _ := strings.Cut(e.Key, ".")
+		p.fields[top] = kindUnknown
+	}
+	return p.add("$addFields", spec)
+}
+
+// Replace each document with the embedded document at expr, e.g. "$address".
+// The new root's fields are unknown, so later references are not checked.
+func (p *Pipeline) ReplaceRoot(expr interface{}) *Pipeline {
+	p.begin("$replaceRoot")
+	p.checkExpr(expr)
+	if path, ok := expr.(string); ok && strings.HasPrefix(path, "$") && !p.open {
+		if p.fields[path[1:]] == kindArray {
+			p.warn("new root %q is an array; $unwind it first", path[1:])
+		}
+	}
+	p.add("$replaceRoot", bson.D{{Key: "newRoot", Value: expr}})
+	p.reshape(map[string]fieldKind{}, true)
+	return p
+}
+
+// One named sub-pipeline of a $facet stage
+type Facet struct {
+	Name  string
+	Build func(*Pipeline)
+}
+
+// Run sub-pipelines over the same input; afterwards each facet is an array
+// field holding its results
+func (p *Pipeline) Facet(facets ...Facet) *Pipeline {
+	p.begin("$facet")
+	spec := bson.D{}
+	fields := map[string]fieldKind{}
+	for _, f := range facets {
+		sub := &Pipeline{fields: map[string]fieldKind{}, removed: map[string]string{}, open: p.open}
+		for name, kind := range p.fields {
+			sub.fields[name] = kind
+		}
+		for name, by := range p.removed {
+			sub.removed[name] = by
+		}
+		f.Build(sub)
+		for _, w := range sub.warnings {
+			p.warn("facet %q: %s", f.Name, w)
+		}
+		spec = append(spec, bson.E{Key: f.Name, Value: sub.stages})
+		fields[f.Name] = kindArray
+	}
+	p.add("$facet", spec)
+	p.reshape(fields, false)
+	return p
+}
+
+// The fields documents have after the last stage, sorted
+func (p *Pipeline) Fields() []string {
+	names := make([]string, 0, len(p.fields))
+	for name := range p.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run the pipeline on coll and decode the results into R
+func Aggregate[R any](ctx context.Context, coll *mongo.Collection, p *Pipeline) ([]R, error) {
+	cursor, err := coll.Aggregate(ctx, p.Stages())
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	var results []R
+	if err := cursor.All(ctx, &results); err != nil {
+		return nil, classifyError(err)
+	}
+	return results, nil
+}
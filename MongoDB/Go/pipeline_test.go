@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPipelineWarnings(t *testing.T) {
+	age := Field[int]{path: "age"}
+
+	tests := []struct {
+		name  string
+		build func(p *Pipeline)
+		want  []string
+	}{
+		{
+			"valid",
+			func(p *Pipeline) {
+				p.Match(docField.Years.Gt(18)).Sort(bson.D{{Key: "years", Value: -1}}).Skip(5).Limit(10)
+			},
+			nil,
+		},
+		{
+			"unwind after project removed the field",
+			func(p *Pipeline) {
+				p.Project(bson.D{{Key: "name", Value: 1}}).Unwind("$reactions")
+			},
+			[]string{`stage 2 ($unwind): field "reactions" was removed by stage 1 ($project)`},
+		},
+		{
+			"limit before skip",
+			func(p *Pipeline) { p.Limit(10).Skip(5) },
+			[]string{"stage 2 ($skip): $skip after $limit returns fewer documents than the limit; skip first for pagination"},
+		},
+		{
+			"sort after limit",
+			func(p *Pipeline) { p.Limit(5).Sort(bson.D{{Key: "years", Value: 1}}) },
+			[]string{"stage 2 ($sort): $sort after $limit only orders the documents the limit kept"},
+		},
+		{
+			"missing field",
+			func(p *Pipeline) { p.Match(age.Gt(1)) },
+			[]string{`stage 1 ($match): field "age" does not exist at this point`},
+		},
+		{
+			"unwind a scalar",
+			func(p *Pipeline) { p.Unwind("$name") },
+			[]string{`stage 1 ($unwind): field "name" is not an array`},
+		},
+		{
+			"field removed by group",
+			func(p *Pipeline) {
+				p.Group("$name", Accumulate("count", "$sum", 1)).Sort(bson.D{{Key: "years", Value: 1}})
+			},
+			[]string{`stage 2 ($sort): field "years" was removed by stage 1 ($group)`},
+		},
+		{
+			"replace root with an array",
+			func(p *Pipeline) { p.ReplaceRoot("$reactions") },
+			[]string{`stage 1 ($replaceRoot): new root "reactions" is an array; $unwind it first`},
+		},
+		{
+			"unwound lookup",
+			func(p *Pipeline) { p.Lookup("orders", "name", "userId", "orders").Unwind("$orders") },
+			nil,
+		},
+		{
+			"facet",
+			func(p *Pipeline) {
+				p.Facet(Facet{Name: "page", Build: func(p *Pipeline) { p.Limit(1).Skip(1) }})
+			},
+			[]string{`stage 1 ($facet): facet "page": stage 2 ($skip): $skip after $limit returns fewer documents than the limit; skip first for pagination`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewPipeline[ExampleDocument]()
+			tt.build(p)
+			if got := p.Warnings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Warnings() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipelineFields(t *testing.T) {
+	p := NewPipeline[ExampleDocument]()
+	want := []string{"_id", "name", "reactionCounts", "reactions", "years"}
+	if got := p.Fields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("initial Fields() = %v, want %v", got, want)
+	}
+	p.Group("$name", Accumulate("count", "$sum", 1), Accumulate("ids", "$push", "$_id"))
+	want = []string{"_id", "count", "ids"}
+	if got := p.Fields(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() after $group = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// The document already holds Reactions.Max reactions
+	ErrTooManyReactions = errors.New("too many reactions")
+	// Emoji are used as field names in reactionCounts
+	ErrInvalidEmoji = errors.New("invalid emoji")
+)
+
+const (
+	defaultMaxReactions = 1000
+	// Page size ListReactors uses when given none
+	defaultReactorLimit = 100
+)
+
+// Reactions on ExampleDocuments: at most one per user, kept in the
+// reactions array with a per-emoji total in reactionCounts. Every change
+// is a single conditional update on the state it was decided from, so
+// the array and the counts always change together, and a change that
+// loses a race with another is decided again from the new state.
+type Reactions struct {
+	coll *mongo.Collection
+	// Reactions one document may hold
+	Max int
+}
+
+func NewReactions(coll *mongo.Collection) *Reactions {
+	return &Reactions{coll: coll, Max: defaultMaxReactions}
+}
+
+var reactionUserID = FieldOf[ExampleDocument, string]("reactions.userId")
+
+// The reactionCounts entry for emoji
+func reactionCount(emoji string) Field[int] {
+	return Field[int]{path: "reactionCounts." + emoji}
+}
+
+func validEmoji(emoji string) error {
+	if emoji == "" || strings.Contains(emoji, ".") || strings.HasPrefix(emoji, "$") {
+		return fmt.Errorf("%w: %q", ErrInvalidEmoji, emoji)
+	}
+	return nil
+}
+
+// Add the user's reaction with emoji, or remove it if the user already
+// reacted with emoji; a reaction with another emoji is changed to emoji.
+// Returns whether the user now reacts with emoji. A toggle is not safe to
+// retry blindly; use SetReaction or RemoveReaction for that.
+func (r *Reactions) ToggleReaction(ctx context.Context, docID primitive.ObjectID, userID, emoji string) (bool, error) {
+	if err := validEmoji(emoji); err != nil {
+		return false, err
+	}
+	now, err := r.change(ctx, docID, userID, func(current string) string {
+		if current == emoji {
+			return ""
+		}
+		return emoji
+	})
+	return now == emoji, err
+}
+
+// Make emoji the user's reaction. Idempotent.
+func (r *Reactions) SetReaction(ctx context.Context, docID primitive.ObjectID, userID, emoji string) error {
+	if err := validEmoji(emoji); err != nil {
+		return err
+	}
+	_, err := r.change(ctx, docID, userID, func(string) string { return emoji })
+	return err
+}
+
+// Remove the user's reaction, if any. Idempotent.
+func (r *Reactions) RemoveReaction(ctx context.Context, docID primitive.ObjectID, userID string) error {
+	_, err := r.change(ctx, docID, userID, func(string) string { return "" })
+	return err
+}
+
+// Read the user's current emoji, decide the new one ("" for none) and
+// write it if the state is still what was read; otherwise read again.
+// Returns the user's emoji afterwards.
+func (r *Reactions) change(ctx context.Context, docID primitive.ObjectID, userID string, decide func(current string) string) (string, error) {
+	for {
+		current, total, err := r.state(ctx, docID, userID)
+		if err != nil {
+			return "", err
+		}
+		target := decide(current)
+		var ok bool
+		switch {
+		case target == current:
+			return current, nil
+		case target == "":
+			ok, err = r.pull(ctx, docID, userID, current)
+		case current != "":
+			ok, err = r.replace(ctx, docID, userID, current, target)
+		case total >= r.Max:
+			return "", fmt.Errorf("%w: document %s has %d", ErrTooManyReactions, docID.Hex(), total)
+		default:
+			ok, err = r.push(ctx, docID, userID, target)
+		}
+		if err != nil || ok {
+			return target, err
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// The user's emoji ("" if none) and the number of reactions on the document
+func (r *Reactions) state(ctx context.Context, docID primitive.ObjectID, userID string) (string, int, error) {
+	projection := bson.D{
+		{Key: "reactions", Value: bson.D{{Key: "$elemMatch", Value: reactionField.UserID.Eq(userID)}}},
+		{Key: "total", Value: bson.D{{Key: "$size", Value: bson.D{{Key: "$ifNull", Value: bson.A{"$reactions", bson.A{}}}}}}},
+	}
+	var doc struct {
+		Reactions []Reaction `bson:"reactions"`
+		Total     int        `bson:"total"`
+	}
+	err := r.coll.FindOne(ctx, docField.ID.Eq(docID), options.FindOne().SetProjection(projection)).Decode(&doc)
+	if err != nil {
+		return "", 0, classifyError(err)
+	}
+	if len(doc.Reactions) == 0 {
+		return "", doc.Total, nil
+	}
+	return doc.Reactions[0].Emoji, doc.Total, nil
+}
+
+// Conditional update; reports whether the document was still in the
+// state the filter describes
+func (r *Reactions) update(ctx context.Context, filter Filter, update *Update, opts ...*options.UpdateOptions) (bool, error) {
+	doc, err := update.Build()
+	if err != nil {
+		return false, err
+	}
+	res, err := r.coll.UpdateOne(ctx, filter, doc, opts...)
+	if err != nil {
+		return false, classifyError(err)
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// The document still has the user's reaction with emoji
+func hasReaction(docID primitive.ObjectID, userID, emoji string) Filter {
+	return And(docField.ID.Eq(docID), ElemMatch(docField.Reactions, reactionField.UserID.Eq(userID), reactionField.Emoji.Eq(emoji)))
+}
+
+func (r *Reactions) push(ctx context.Context, docID primitive.ObjectID, userID, emoji string) (bool, error) {
+	// No reaction from the user yet, and fewer than Max in all
+	full := Field[Reaction]{path: fmt.Sprintf("reactions.%d", r.Max-1)}
+	filter := And(docField.ID.Eq(docID), reactionUserID.Ne(userID), full.Exists(false))
+	return r.update(ctx, filter, NewUpdate(
+		Push(docField.Reactions, Reaction{UserID: userID, Emoji: emoji}),
+		Inc(reactionCount(emoji), 1),
+	))
+}
+
+func (r *Reactions) pull(ctx context.Context, docID primitive.ObjectID, userID, emoji string) (bool, error) {
+	ok, err := r.update(ctx, hasReaction(docID, userID, emoji), NewUpdate(
+		PullWhere(docField.Reactions, reactionField.UserID.Eq(userID)),
+		Inc(reactionCount(emoji), -1),
+	))
+	if ok && err == nil {
+		err = r.dropZeroCount(ctx, docID, emoji)
+	}
+	return ok, err
+}
+
+// Change the user's emoji in place, keeping the reaction's position
+func (r *Reactions) replace(ctx context.Context, docID primitive.ObjectID, userID, from, to string) (bool, error) {
+	mine := options.ArrayFilters{Filters: []interface{}{
+		bson.D{{Key: "r.userId", Value: userID}},
+	}}
+	ok, err := r.update(ctx, hasReaction(docID, userID, from), NewUpdate(
+		Set(Field[string]{path: "reactions.$[r].emoji"}, to),
+		Inc(reactionCount(from), -1),
+		Inc(reactionCount(to), 1),
+	), options.Update().SetArrayFilters(mine))
+	if ok && err == nil {
+		err = r.dropZeroCount(ctx, docID, from)
+	}
+	return ok, err
+}
+
+// Remove an emoji's count once it reaches zero. A concurrent reaction with
+// the emoji makes the count positive again, and then it is left alone.
+func (r *Reactions) dropZeroCount(ctx context.Context, docID primitive.ObjectID, emoji string) error {
+	_, err := r.update(ctx, And(docField.ID.Eq(docID), reactionCount(emoji).Lte(0)), NewUpdate(Unset(reactionCount(emoji))))
+	return err
+}
+
+// One page of reactions on a document, in the order they were added
+type ReactorPage struct {
+	Reactions []Reaction
+	// Reactions across all pages
+	Total int
+}
+
+// The users who reacted to a document with emoji, or with anything if
+// emoji is "", skipping offset and returning at most limit. A limit of zero
+// or less means defaultReactorLimit.
+func (r *Reactions) ListReactors(ctx context.Context, docID primitive.ObjectID, emoji string, offset, limit int64) (ReactorPage, error) {
+	if limit <= 0 {
+		limit = defaultReactorLimit
+	}
+	offset = max(offset, 0)
+	p := NewPipeline[ExampleDocument]().
+		Match(docField.ID.Eq(docID)).
+		Unwind("$reactions")
+	if emoji != "" {
+		p.Match(FieldOf[ExampleDocument, string]("reactions.emoji").Eq(emoji))
+	}
+	p.Facet(
+		Facet{Name: "page", Build: func(p *Pipeline) {
+			p.Skip(offset).Limit(limit).Project(bson.D{{Key: "reactions", Value: 1}, {Key: "_id", Value: 0}})
+		}},
+		Facet{Name: "total", Build: func(p *Pipeline) {
+			p.Group(nil, Accumulate("count", "$sum", 1))
+		}},
+	)
+	results, err := Aggregate[struct {
+		Page []struct {
+			Reaction Reaction `bson:"reactions"`
+		} `bson:"page"`
+		Total []struct {
+			Count int `bson:"count"`
+		} `bson:"total"`
+	}](ctx, r.coll, p)
+	if err != nil || len(results) == 0 {
+		return ReactorPage{}, err
+	}
+	var page ReactorPage
+	for _, item := range results[0].Page {
+		page.Reactions = append(page.Reactions, item.Reaction)
+	}
+	if len(results[0].Total) > 0 {
+		page.Total = results[0].Total[0].Count
+	}
+	return page, nil
+}
+
+// Rebuild reactionCounts from the reactions array on every document
+// matching filter, for documents whose reactions were edited directly
+func (r *Reactions) Recount(ctx context.Context, filter Filter) (int64, error) {
+	update := mongo.Pipeline{bson.D{{Key: "$set", Value: bson.D{{Key: "reactionCounts", Value: reactionCountsExpr()}}}}}
+	res, err := r.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	return res.ModifiedCount, nil
+}
+
+// An aggregation expression for reactionCounts computed from reactions
+func reactionCountsExpr() bson.D {
+	return bson.D{{Key: "$arrayToObject", Value: bson.D{{Key: "$map", Value: bson.D{
+		{Key: "input", Value: bson.D{{Key: "$setUnion", Value: bson.A{bson.D{{Key: "$ifNull", Value: bson.A{"$reactions.emoji", bson.A{}}}}}}}},
+		{Key: "as", Value: "emoji"},
+		{Key: "in", Value: bson.D{
+			{Key: "k", Value: "$$emoji"},
+			{Key: "v", Value: bson.D{{Key: "$size", Value: bson.D{{Key: "$filter", Value: bson.D{
+				{Key: "input", Value: "$reactions"},
+				{Key: "cond", Value: bson.D{{Key: "$eq", Value: bson.A{"$$this.emoji", "$$emoji"}}}},
+			}}}}}},
+		}},
+	}}}}}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// No document matched the filter
+	ErrNotFound = errors.New("document not found")
+	// A unique index rejected the write
+	ErrDuplicateKey = errors.New("duplicate key")
+	// The write was applied on the primary but the write concern was not
+	// satisfied, so it may still be rolled back
+	ErrWriteConcern = errors.New("write concern not satisfied")
+)
+
+// Typed access to one collection. Documents are decoded into T, and driver
+// errors are mapped to ErrNotFound, ErrDuplicateKey and ErrWriteConcern,
+// which wrap the original error so errors.As still reaches it.
+type Repository[T any] struct {
+	coll   *mongo.Collection
+	schema *Schema
+}
+
+func NewRepository[T any](coll *mongo.Collection) *Repository[T] {
+	return &Repository[T]{coll: coll}
+}
+
+func (r *Repository[T]) Collection() *mongo.Collection {
+	return r.coll
+}
+
+// Upgrade documents older than the schema as they are read, and stamp the
+// schema's version on documents as they are written
+func (r *Repository[T]) WithSchema(s *Schema) *Repository[T] {
+	r.schema = s
+	return r
+}
+
+func (r *Repository[T]) decode(raw bson.Raw) (T, error) {
+	var doc T
+	if r.schema == nil {
+		return doc, bson.Unmarshal(raw, &doc)
+	}
+	var d bson.D
+	if err := bson.Unmarshal(raw, &d); err != nil {
+		return doc, err
+	}
+	d, err := r.schema.Upgrade(d)
+	if err != nil {
+		return doc, err
+	}
+	b, err := bson.Marshal(d)
+	if err != nil {
+		return doc, err
+	}
+	return doc, bson.Unmarshal(b, &doc)
+}
+
+func (r *Repository[T]) encode(doc T) (interface{}, error) {
+	if r.schema == nil {
+		return doc, nil
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return setPath(d, []string{schemaVersionField}, int32(r.schema.Version())), nil
+}
+
+// Insert one document and return its _id
+func (r *Repository[T]) Insert(ctx context.Context, doc T) (interface{}, error) {
+	encoded, err := r.encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.coll.InsertOne(ctx, encoded)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	return res.InsertedID, nil
+}
+
+// Insert documents in order and return their _ids. On error the _ids of
+// the documents inserted before the failure are returned as well.
+func (r *Repository[T]) InsertMany(ctx context.Context, docs []T, opts ...*options.InsertManyOptions) ([]interface{}, error) {
+	if len(docs) == 0 {
+		return nil, nil
+	}
+	batch := make([]interface{}, len(docs))
+	for i, doc := range docs {
+		encoded, err := r.encode(doc)
+		if err != nil {
+			return nil, err
+		}
+		batch[i] = encoded
+	}
+	res, err := r.coll.InsertMany(ctx, batch, opts...)
+	var ids []interface{}
+	if res != nil {
+		ids = res.InsertedIDs
+	}
+	return ids, classifyError(err)
+}
+
+func (r *Repository[T]) FindOne(ctx context.Context, filter interface{}, opts ...*options.FindOneOptions) (T, error) {
+	raw, err := r.coll.FindOne(ctx, filter, opts...).Raw()
+	if err != nil {
+		var doc T
+		return doc, classifyError(err)
+	}
+	return r.decode(raw)
+}
+
+func (r *Repository[T]) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := r.coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, classifyError(err)
+	}
+	defer cursor.Close(ctx)
+	var docs []T
+	for cursor.Next(ctx) {
+		doc, err := r.decode(cursor.Current)
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, classifyError(cursor.Err())
+}
+
+func (r *Repository[T]) Count(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	n, err := r.coll.CountDocuments(ctx, filter, opts...)
+	return n, classifyError(err)
+}
+
+// Update the first matching document; ErrNotFound if none matched and the
+// update is not an upsert
+func (r *Repository[T]) UpdateOne(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	res, err := r.coll.UpdateOne(ctx, filter, update, opts...)
+	if err != nil {
+		return res, classifyError(err)
+	}
+	if res.MatchedCount == 0 && res.UpsertedCount == 0 {
+		return res, ErrNotFound
+	}
+	return res, nil
+}
+
+// Update every matching document; matching none is not an error
+func (r *Repository[T]) Update(ctx context.Context, filter, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	res, err := r.coll.UpdateMany(ctx, filter, update, opts...)
+	return res, classifyError(err)
+}
+
+// Replace the first matching document; ErrNotFound if none matched and the
+// replacement is not an upsert
+func (r *Repository[T]) Replace(ctx context.Context, filter interface{}, doc T, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	encoded, err := r.encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	res, err := r.coll.ReplaceOne(ctx, filter, encoded, opts...)
+	if err != nil {
+		return res, classifyError(err)
+	}
+	if res.MatchedCount == 0 && res.UpsertedCount == 0 {
+		return res, ErrNotFound
+	}
+	return res, nil
+}
+
+// Delete the first matching document; ErrNotFound if none matched
+func (r *Repository[T]) DeleteOne(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) error {
+	res, err := r.coll.DeleteOne(ctx, filter, opts...)
+	if err != nil {
+		return classifyError(err)
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete every matching document and return how many were deleted
+func (r *Repository[T]) Delete(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (int64, error) {
+	res, err := r.coll.DeleteMany(ctx, filter, opts...)
+	if err != nil {
+		return 0, classifyError(err)
+	}
+	return res.DeletedCount, nil
+}
+
+// Map driver errors to the repository's error values
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("%w: %w", ErrNotFound, err)
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("%w: %w", ErrDuplicateKey, err)
+	}
+	var we mongo.WriteException
+	if errors.As(err, &we) && we.WriteConcernError != nil {
+		return fmt.Errorf("%w: %w", ErrWriteConcern, err)
+	}
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError != nil {
+		return fmt.Errorf("%w: %w", ErrWriteConcern, err)
+	}
+	return err
+}
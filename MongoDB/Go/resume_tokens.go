@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Persists change stream resume tokens by watcher name. Load returns nil
+// when no token has been saved.
+type ResumeTokenStore interface {
+	Load(ctx context.Context, name string) (bson.Raw, error)
+	Save(ctx context.Context, name string, token bson.Raw) error
+	Clear(ctx context.Context, name string) error
+}
+
+// Tokens in <Dir>/<name>.token, replaced atomically on every save
+type FileTokenStore struct {
+	Dir string
+}
+
+func (s FileTokenStore) path(name string) string {
+	return filepath.Join(s.Dir, name+".token")
+}
+
+func (s FileTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	data, err := os.ReadFile(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(data), nil
+}
+
+func (s FileTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, name+".token.*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(token); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(name))
+}
+
+func (s FileTokenStore) Clear(ctx context.Context, name string) error {
+	err := os.Remove(s.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Tokens as documents {_id: name, token, updatedAt} in a collection
+type MongoTokenStore struct {
+	Collection *mongo.Collection
+}
+
+func (s MongoTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	var doc struct {
+		Token bson.Raw `bson:"token"`
+	}
+	err := s.Collection.FindOne(ctx, bson.D{{Key: "_id", Value: name}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return doc.Token, nil
+}
+
+func (s MongoTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "token", Value: token},
+		{Key: "updatedAt", Value: time.Now()},
+	}}}
+	_, err := s.Collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: name}}, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s MongoTokenStore) Clear(ctx context.Context, name string) error {
+	_, err := s.Collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: name}})
+	return err
+}
+
+// Tokens as raw BSON under <Prefix><name>
+type RedisTokenStore struct {
+	Client *redis.Client
+	Prefix string
+}
+
+func (s RedisTokenStore) Load(ctx context.Context, name string) (bson.Raw, error) {
+	data, err := s.Client.Get(ctx, s.Prefix+name).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw(data), nil
+}
+
+func (s RedisTokenStore) Save(ctx context.Context, name string, token bson.Raw) error {
+	return s.Client.Set(ctx, s.Prefix+name, []byte(token), 0).Err()
+}
+
+func (s RedisTokenStore) Clear(ctx context.Context, name string) error {
+	return s.Client.Del(ctx, s.Prefix+name).Err()
+}
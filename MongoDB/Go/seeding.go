@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Documents loaded from the dataset written by the PostgreSQL seed command
+// (go run . seed -out <dir> in PostgreSQL/Go), so benchmarks compare the
+// same users and orders across databases.
+type SeedUser struct {
+	UserID int    `bson:"userId" json:"id"`
+	Name   string `bson:"name" json:"name"`
+	Email  string `bson:"email" json:"email"`
+	Age    int    `bson:"age" json:"age"`
+}
+
+type SeedOrder struct {
+	OrderID int    `bson:"orderId" json:"id"`
+	UserID  int    `bson:"userId" json:"user_id"`
+	Product string `bson:"product" json:"product"`
+	Amount  int    `bson:"amount" json:"amount"`
+}
+
+const seedBatchSize = 1000
+
+// Load a seed dataset into the users and orders collections:
+//
+//	go run . seed -dir ../../dataset
+func seedCommand(args []string) {
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	dir := flags.String("dir", "dataset", "directory containing users.jsonl and orders.jsonl")
+	reset := flags.Bool("reset", false, "drop the users and orders collections first")
+	flags.Parse(args)
+
+	db := collection.Database()
+	users := db.Collection("users")
+	orders := db.Collection("orders")
+	if *reset {
+		if err := users.Drop(context.TODO()); err != nil {
+			log.Fatal(err)
+		}
+		if err := orders.Drop(context.TODO()); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	n, err := loadJSONLines[SeedUser](users, filepath.Join(*dir, "users.jsonl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Seeded users:", n)
+
+	n, err = loadJSONLines[SeedOrder](orders, filepath.Join(*dir, "orders.jsonl"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Seeded orders:", n)
+}
+
+// Stream a JSON Lines file into coll with unordered InsertMany batches
+func loadJSONLines[T any](coll *mongo.Collection, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	total := 0
+	batch := make([]interface{}, 0, seedBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := coll.InsertMany(context.TODO(), batch, options.InsertMany().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		total += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var doc T
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			return total, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		batch = append(batch, doc)
+		if len(batch) == seedBatchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return total, err
+	}
+	return total, flush()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Concerns and limits for WithTransaction
+type TxOptions struct {
+	ReadConcern    *readconcern.ReadConcern
+	WriteConcern   *writeconcern.WriteConcern
+	ReadPreference *readpref.ReadPref
+	// Hard deadline for the whole transaction including every retry
+	Timeout time.Duration
+}
+
+// Snapshot reads, majority writes and the primary, within 10 seconds
+func DefaultTxOptions() TxOptions {
+	return TxOptions{
+		ReadConcern:    readconcern.Snapshot(),
+		WriteConcern:   writeconcern.Majority(),
+		ReadPreference: readpref.Primary(),
+		Timeout:        10 * time.Second,
+	}
+}
+
+// Error labels the server attaches to retryable transaction failures
+const (
+	labelTransientTransaction = "TransientTransactionError"
+	labelUnknownCommitResult  = "UnknownTransactionCommitResult"
+)
+
+// Run fn in a multi-document transaction. fn must do all its reads and
+// writes with the SessionContext it is given, and may run more than once:
+// the whole transaction is retried on TransientTransactionError, and the
+// commit alone is retried on UnknownTransactionCommitResult, until
+// opts.Timeout expires.
+func WithTransaction(ctx context.Context, opts TxOptions, fn func(mongo.SessionContext) error) error {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(context.Background())
+
+	txnOpts := options.Transaction().
+		SetReadConcern(opts.ReadConcern).
+		SetWriteConcern(opts.WriteConcern).
+		SetReadPreference(opts.ReadPreference)
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if berr := backoff(ctx, attempt); berr != nil {
+				return fmt.Errorf("transaction gave up after %d attempts: %w: %w", attempt, berr, err)
+			}
+		}
+		err = mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+			if err := session.StartTransaction(txnOpts); err != nil {
+				return err
+			}
+			if err := fn(sc); err != nil {
+				session.AbortTransaction(context.Background())
+				return err
+			}
+			return commit(sc, session)
+		})
+		if err == nil {
+			return nil
+		}
+		if !hasErrorLabel(err, labelTransientTransaction) || ctx.Err() != nil {
+			return classifyError(err)
+		}
+	}
+}
+
+// Commit, retrying with backoff while the outcome is unknown. Committing
+// again is safe: the server recognises the transaction and reports its real
+// outcome.
+func commit(ctx context.Context, session mongo.Session) error {
+	for attempt := 1; ; attempt++ {
+		err := session.CommitTransaction(ctx)
+		if err == nil || !hasErrorLabel(err, labelUnknownCommitResult) || ctx.Err() != nil {
+			return err
+		}
+		if berr := backoff(ctx, attempt); berr != nil {
+			return fmt.Errorf("commit gave up after %d attempts: %w: %w", attempt, berr, err)
+		}
+	}
+}
+
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
+
+// Sleep 10ms doubling per attempt up to 1s, with jitter, or until ctx is done
+func backoff(ctx context.Context, attempt int) error {
+	d := 10 * time.Millisecond << min(attempt, 7)
+	d = min(d, time.Second)
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// Accounts moved between atomically by transfer
+type Account struct {
+	ID      string `bson:"_id"`
+	Balance int64  `bson:"balance"`
+}
+
+var ErrInsufficientBalance = errors.New("insufficient balance")
+
+// Move amount from one account to another, both or neither
+func transfer(ctx context.Context, accounts *mongo.Collection, from, to string, amount int64) error {
+	return WithTransaction(ctx, DefaultTxOptions(), func(sc mongo.SessionContext) error {
+		res, err := accounts.UpdateOne(sc,
+			bson.D{{Key: "_id", Value: from}, {Key: "balance", Value: bson.D{{Key: "$gte", Value: amount}}}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "balance", Value: -amount}}}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("%w: account %s", ErrInsufficientBalance, from)
+		}
+		res, err = accounts.UpdateOne(sc,
+			bson.D{{Key: "_id", Value: to}},
+			bson.D{{Key: "$inc", Value: bson.D{{Key: "balance", Value: amount}}}})
+		if err != nil {
+			return err
+		}
+		if res.MatchedCount == 0 {
+			return fmt.Errorf("%w: account %s", ErrNotFound, to)
+		}
+		return nil
+	})
+}
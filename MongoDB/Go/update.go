@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// One update operator applied to one field
+type UpdateOp struct {
+	Operator string
+	Path     string
+	Value    interface{}
+}
+
+// Paths the operation reads or writes; $rename touches its target too
+func (op UpdateOp) paths() []string {
+	if op.Operator == "$rename" {
+		return []string{op.Path, op.Value.(string)}
+	}
+	return []string{op.Path}
+}
+
+func (op UpdateOp) String() string {
+	return op.Operator + " " + op.Path
+}
+
+type Number interface {
+	~int | ~int32 | ~int64 | ~float32 | ~float64
+}
+
+func Set[V any](f Field[V], v V) UpdateOp {
+	return UpdateOp{"$set", f.Path(), v}
+}
+
+func SetOnInsert[V any](f Field[V], v V) UpdateOp {
+	return UpdateOp{"$setOnInsert", f.Path(), v}
+}
+
+func Unset[V any](f Field[V]) UpdateOp {
+	return UpdateOp{"$unset", f.Path(), ""}
+}
+
+func Inc[V Number](f Field[V], by V) UpdateOp {
+	return UpdateOp{"$inc", f.Path(), by}
+}
+
+func Mul[V Number](f Field[V], by V) UpdateOp {
+	return UpdateOp{"$mul", f.Path(), by}
+}
+
+func Min[V any](f Field[V], v V) UpdateOp {
+	return UpdateOp{"$min", f.Path(), v}
+}
+
+func Max[V any](f Field[V], v V) UpdateOp {
+	return UpdateOp{"$max", f.Path(), v}
+}
+
+// Rename the field to a new top-level or dotted name
+func Rename[V any](f Field[V], to string) UpdateOp {
+	return UpdateOp{"$rename", f.Path(), to}
+}
+
+func Push[E any](f Field[[]E], v E) UpdateOp {
+	return UpdateOp{"$push", f.Path(), v}
+}
+
+func AddToSet[E any](f Field[[]E], v E) UpdateOp {
+	return UpdateOp{"$addToSet", f.Path(), v}
+}
+
+// Remove elements equal to v
+func Pull[E any](f Field[[]E], v E) UpdateOp {
+	return UpdateOp{"$pull", f.Path(), v}
+}
+
+// Remove elements matching all filters, with element-relative fields
+func PullWhere[E any](f Field[[]E], filters ...Filter) UpdateOp {
+	return UpdateOp{"$pull", f.Path(), And(filters...).BSON()}
+}
+
+func PopFirst[E any](f Field[[]E]) UpdateOp {
+	return UpdateOp{"$pop", f.Path(), -1}
+}
+
+func PopLast[E any](f Field[[]E]) UpdateOp {
+	return UpdateOp{"$pop", f.Path(), 1}
+}
+
+// Two operations MongoDB would reject in a single update because their
+// paths are equal or one contains the other
+type UpdateConflict struct {
+	First, Second UpdateOp
+}
+
+func (c UpdateConflict) String() string {
+	return fmt.Sprintf("%s conflicts with %s", c.First, c.Second)
+}
+
+type UpdateConflictError struct {
+	Conflicts []UpdateConflict
+}
+
+func (e *UpdateConflictError) Error() string {
+	parts := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		parts[i] = c.String()
+	}
+	return "conflicting update paths: " + strings.Join(parts, "; ")
+}
+
+// Composes update operators into an update document, checking for
+// conflicting paths before anything is sent
+type Update struct {
+	ops []UpdateOp
+}
+
+func NewUpdate(ops ...UpdateOp) *Update {
+	return &Update{ops: ops}
+}
+
+func (u *Update) Add(ops ...UpdateOp) *Update {
+	u.ops = append(u.ops, ops...)
+	return u
+}
+
+func (u *Update) Conflicts() []UpdateConflict {
+	var conflicts []UpdateConflict
+	for i, a := range u.ops {
+		for _, b := range u.ops[i+1:] {
+			if opsConflict(a, b) {
+				conflicts = append(conflicts, UpdateConflict{a, b})
+			}
+		}
+	}
+	return conflicts
+}
+
+// The update document, or an *UpdateConflictError listing every conflict
+func (u *Update) Build() (bson.D, error) {
+	if conflicts := u.Conflicts(); len(conflicts) > 0 {
+		return nil, &UpdateConflictError{conflicts}
+	}
+	return render(u.ops), nil
+}
+
+// Split the operations into updates that are each free of conflicts and,
+// applied in order, have the effect of applying the operations in order.
+// Each operation goes into the first update after every earlier operation
+// it conflicts with. Later updates see the document the earlier ones left,
+// so filter the sequence by _id rather than by fields it changes.
+func (u *Update) Split() []bson.D {
+	var groups [][]UpdateOp
+	placed := make([]int, len(u.ops))
+	for i, op := range u.ops {
+		group := 0
+		for j := 0; j < i; j++ {
+			if opsConflict(u.ops[j], op) && placed[j] >= group {
+				group = placed[j] + 1
+			}
+		}
+		if group == len(groups) {
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], op)
+		placed[i] = group
+	}
+
+	updates := make([]bson.D, len(groups))
+	for i, g := range groups {
+		updates[i] = render(g)
+	}
+	return updates
+}
+
+// Group operations by operator, keeping first-seen order
+func render(ops []UpdateOp) bson.D {
+	var update bson.D
+	index := map[string]int{}
+	for _, op := range ops {
+		i, ok := index[op.Operator]
+		if !ok {
+			i = len(update)
+			index[op.Operator] = i
+			update = append(update, bson.E{Key: op.Operator, Value: bson.D{}})
+		}
+		fields := update[i].Value.(bson.D)
+		update[i].Value = append(fields, bson.E{Key: op.Path, Value: op.Value})
+	}
+	return update
+}
+
+func opsConflict(a, b UpdateOp) bool {
+	for _, p := range a.paths() {
+		for _, q := range b.paths() {
+			if pathsOverlap(p, q) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Equal paths, or one a parent of the other: "a" and "a.b" overlap, "a" and
+// "ab" do not
+func pathsOverlap(p, q string) bool {
+	if len(p) > len(q) {
+		p, q = q, p
+	}
+	return p == q || strings.HasPrefix(q, p+".")
+}
+
+// Apply a split update sequence to the first matching document in one
+// transaction, so readers never see it half applied
+func applyUpdates(ctx context.Context, coll *mongo.Collection, filter interface{}, updates []bson.D) error {
+	return WithTransaction(ctx, DefaultTxOptions(), func(sc mongo.SessionContext) error {
+		for _, update := range updates {
+			if _, err := coll.UpdateOne(sc, filter, update); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPathsOverlap(t *testing.T) {
+	tests := []struct {
+		p, q string
+		want bool
+	}{
+		{"age", "age", true},
+		{"a", "a.b", true},
+		{"a.b", "a", true},
+		{"a", "a.b.c", true},
+		{"a.b", "a.b.c", true},
+		{"a", "ab", false},
+		{"ab", "a", false},
+		{"a.b", "a.c", false},
+		{"a.b", "a.bc", false},
+		{"reactions.0", "reactions.1", false},
+		{"reactions", "reactions.0.emoji", true},
+	}
+	for _, tt := range tests {
+		if got := pathsOverlap(tt.p, tt.q); got != tt.want {
+			t.Errorf("pathsOverlap(%q, %q) = %t, want %t", tt.p, tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateConflicts(t *testing.T) {
+	age := Field[int]{path: "age"}
+	name := Field[string]{path: "name"}
+	address := Field[testAddress]{path: "address"}
+	city := Field[string]{path: "address.city"}
+
+	tests := []struct {
+		name string
+		ops  []UpdateOp
+		want []UpdateConflict
+	}{
+		{"distinct fields", []UpdateOp{Set(age, 1), Set(name, "a"), Set(city, "Oslo")}, nil},
+		{"same field", []UpdateOp{Set(age, 1), Inc(age, 1)}, []UpdateConflict{{Set(age, 1), Inc(age, 1)}}},
+		{"parent and child", []UpdateOp{Unset(address), Set(city, "Oslo")}, []UpdateConflict{{Unset(address), Set(city, "Oslo")}}},
+		{"rename target", []UpdateOp{Rename(name, "age"), Inc(age, 1)}, []UpdateConflict{{Rename(name, "age"), Inc(age, 1)}}},
+		{
+			"every pair",
+			[]UpdateOp{Set(age, 1), Inc(age, 1), Max(age, 5)},
+			[]UpdateConflict{{Set(age, 1), Inc(age, 1)}, {Set(age, 1), Max(age, 5)}, {Inc(age, 1), Max(age, 5)}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := NewUpdate(tt.ops...)
+			if got := u.Conflicts(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Conflicts() = %v, want %v", got, tt.want)
+			}
+			_, err := u.Build()
+			var conflictErr *UpdateConflictError
+			if got := errors.As(err, &conflictErr); got != (len(tt.want) > 0) {
+				t.Errorf("Build() error = %v, want a conflict error: %t", err, len(tt.want) > 0)
+			}
+		})
+	}
+}
+
+func TestUpdateSplit(t *testing.T) {
+	age := Field[int]{path: "age"}
+	years := Field[int]{path: "years"}
+	name := Field[string]{path: "name"}
+
+	tests := []struct {
+		name string
+		ops  []UpdateOp
+		want []bson.D
+	}{
+		{
+			"no conflicts",
+			[]UpdateOp{Set(age, 30), Set(name, "a"), Inc(years, 1)},
+			[]bson.D{{
+				{Key: "$set", Value: bson.D{{Key: "age", Value: 30}, {Key: "name", Value: "a"}}},
+				{Key: "$inc", Value: bson.D{{Key: "years", Value: 1}}},
+			}},
+		},
+		{
+			// Each operation on age waits for the previous one; name does
+			// not touch age and goes into the first update
+			"set, inc and rename of age",
+			[]UpdateOp{Set(age, 30), Inc(age, 1), Rename(age, "years"), Set(name, "a")},
+			[]bson.D{
+				{{Key: "$set", Value: bson.D{{Key: "age", Value: 30}, {Key: "name", Value: "a"}}}},
+				{{Key: "$inc", Value: bson.D{{Key: "age", Value: 1}}}},
+				{{Key: "$rename", Value: bson.D{{Key: "age", Value: "years"}}}},
+			},
+		},
+		{
+			"rename then write the new name",
+			[]UpdateOp{Rename(age, "years"), Inc(years, 1), Set(age, 0)},
+			[]bson.D{
+				{{Key: "$rename", Value: bson.D{{Key: "age", Value: "years"}}}},
+				{
+					{Key: "$inc", Value: bson.D{{Key: "years", Value: 1}}},
+					{Key: "$set", Value: bson.D{{Key: "age", Value: 0}}},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewUpdate(tt.ops...).Split(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Split() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// One change stream event with the changed document decoded into T.
+// FullDocument is the document after the change for inserts, replaces and
+// (through update lookup) updates, and nil for deletes and invalidations.
+type ChangeEvent[T any] struct {
+	ResumeToken   bson.Raw `bson:"_id"`
+	OperationType string   `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument      *T                  `bson:"fullDocument"`
+	UpdateDescription *UpdateDescription  `bson:"updateDescription,omitempty"`
+	ClusterTime       primitive.Timestamp `bson:"clusterTime"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields bson.M   `bson:"updatedFields"`
+	RemovedFields []string `bson:"removedFields"`
+}
+
+// Server error codes after which the saved token cannot be used again
+const (
+	codeInvalidResumeToken      = 260
+	codeChangeStreamFatalError  = 280
+	codeChangeStreamHistoryLost = 286
+)
+
+// Watches a collection and hands each change to a handler, saving the
+// resume token after the handler returns. Delivery is at least once: an
+// event whose token was not saved before a crash is delivered again.
+//
+// Change streams need a replica set; a local single node works:
+//
+//	mongod --replSet rs0 --dbpath data
+//	mongosh --eval 'rs.initiate()'
+type Watcher[T any] struct {
+	coll  *mongo.Collection
+	name  string
+	store ResumeTokenStore
+
+	// Optional $match or $project stages applied to the change stream
+	Pipeline mongo.Pipeline
+	// Wait before reopening the stream after a failure
+	RetryInterval time.Duration
+}
+
+func NewWatcher[T any](coll *mongo.Collection, name string, store ResumeTokenStore) *Watcher[T] {
+	return &Watcher[T]{coll: coll, name: name, store: store, RetryInterval: 5 * time.Second}
+}
+
+// Watch until ctx is done or handle returns an error. The stream resumes
+// from the saved token after restarts; after an invalidate event (the
+// collection was dropped or renamed) it starts again after that event, and
+// when the token has fallen off the oplog it starts from now.
+func (w *Watcher[T]) Run(ctx context.Context, handle func(context.Context, ChangeEvent[T]) error) error {
+	pipeline := w.Pipeline
+	if pipeline == nil {
+		pipeline = mongo.Pipeline{}
+	}
+	for {
+		err := w.watch(ctx, pipeline, handle)
+		var handlerErr handlerError
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case errors.As(err, &handlerErr):
+			return handlerErr.err
+		case err == nil:
+			// Invalidated; reopen after the invalidate event right away
+			continue
+		case isStaleResumeToken(err):
+			log.Printf("Watcher %s: resume token is no longer valid, starting from now: %v\n", w.name, err)
+			if err := w.store.Clear(ctx, w.name); err != nil {
+				return err
+			}
+			continue
+		case err != nil:
+			log.Printf("Watcher %s: change stream failed, retrying in %s: %v\n", w.name, w.RetryInterval, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(w.RetryInterval):
+		}
+	}
+}
+
+type handlerError struct {
+	err error
+}
+
+func (e handlerError) Error() string {
+	return e.err.Error()
+}
+
+// Open one change stream and read it until it fails or is invalidated
+func (w *Watcher[T]) watch(ctx context.Context, pipeline mongo.Pipeline, handle func(context.Context, ChangeEvent[T]) error) error {
+	token, err := w.store.Load(ctx, w.name)
+	if err != nil {
+		return fmt.Errorf("load resume token: %w", err)
+	}
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		// StartAfter, unlike ResumeAfter, also accepts an invalidate token
+		opts.SetStartAfter(token)
+	}
+	stream, err := w.coll.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event ChangeEvent[T]
+		if err := stream.Decode(&event); err != nil {
+			return handlerError{fmt.Errorf("decode change event: %w", err)}
+		}
+		if event.OperationType != "invalidate" {
+			if err := handle(ctx, event); err != nil {
+				return handlerError{err}
+			}
+		}
+		if err := w.store.Save(ctx, w.name, stream.ResumeToken()); err != nil {
+			return fmt.Errorf("save resume token: %w", err)
+		}
+		if event.OperationType == "invalidate" {
+			log.Printf("Watcher %s: change stream invalidated, reopening\n", w.name)
+			return nil
+		}
+	}
+	return stream.Err()
+}
+
+func isStaleResumeToken(err error) bool {
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	return se.HasErrorCode(codeInvalidResumeToken) ||
+		se.HasErrorCode(codeChangeStreamFatalError) ||
+		se.HasErrorCode(codeChangeStreamHistoryLost)
+}
+
+// Print changes to example_collection until interrupted:
+//
+//	go run . watch -store file -dir tokens
+//	go run . watch -store redis -redis-addr localhost:6379
+func watchCommand(args []string) {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	name := flags.String("name", collectionName, "watcher name the resume token is saved under")
+	storeKind := flags.String("store", "file", "resume token store: file, mongo or redis")
+	dir := flags.String("dir", "resume-tokens", "directory for the file store")
+	redisAddr := flags.String("redis-addr", "localhost:6379", "address for the redis store")
+	flags.Parse(args)
+
+	var store ResumeTokenStore
+	switch *storeKind {
+	case "file":
+		store = FileTokenStore{Dir: *dir}
+	case "mongo":
+		store = MongoTokenStore{Collection: collection.Database().Collection("resume_tokens")}
+	case "redis":
+		store = RedisTokenStore{Client: redis.NewClient(&redis.Options{Addr: *redisAddr}), Prefix: "resume-token:"}
+	default:
+		log.Fatalf("unknown resume token store %q", *storeKind)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	watcher := NewWatcher[ExampleDocument](collection, *name, store)
+	err := watcher.Run(ctx, func(ctx context.Context, event ChangeEvent[ExampleDocument]) error {
+		fmt.Println("Change:", event.OperationType, event.DocumentKey.ID)
+		if event.FullDocument != nil {
+			fmt.Println("  Document:", *event.FullDocument)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
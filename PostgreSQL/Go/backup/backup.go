@@ -0,0 +1,199 @@
+// Package backup writes and restores logical backups of a PostgreSQL schema
+// without depending on pg_dump.
+//
+// An archive is a tar file, optionally gzip-compressed, containing in order:
+//
+//	manifest.json    tables in foreign-key order with row counts and checksums
+//	schema.sql       enum types, sequences and tables with their constraints
+//	data/<table>.csv one COPY ... (FORMAT csv) stream per table
+//	post-data.sql    indexes and sequence positions
+package backup
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const (
+	manifestFile = "manifest.json"
+	schemaFile   = "schema.sql"
+	postDataFile = "post-data.sql"
+
+	formatVersion = 1
+)
+
+type Manifest struct {
+	Version       int          `json:"version"`
+	CreatedAt     time.Time    `json:"created_at"`
+	ServerVersion string       `json:"server_version"`
+	Schema        string       `json:"schema"`
+	Tables        []TableEntry `json:"tables"`
+}
+
+type TableEntry struct {
+	Name      string   `json:"name"`
+	Columns   []string `json:"columns"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	DataFile  string   `json:"data_file"`
+	Rows      int64    `json:"rows"`
+	SHA256    string   `json:"sha256"`
+}
+
+type Options struct {
+	// Schema to back up; defaults to public
+	Schema string
+	// Gzip-compress the archive
+	Compress bool
+}
+
+// Backup writes an archive of every table in opts.Schema to w. All tables
+// are read in one REPEATABLE READ transaction, so the archive is a
+// consistent snapshot.
+func Backup(ctx context.Context, pool *pgxpool.Pool, w io.Writer, opts Options) (*Manifest, error) {
+	if opts.Schema == "" {
+		opts.Schema = "public"
+	}
+	spool, err := os.MkdirTemp("", "pg-backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(spool)
+
+	manifest := &Manifest{Version: formatVersion, CreatedAt: time.Now().UTC(), Schema: opts.Schema}
+	var preData, postData string
+
+	err = pool.BeginTxFunc(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		if err := tx.QueryRow(ctx, "SHOW server_version").Scan(&manifest.ServerVersion); err != nil {
+			return err
+		}
+		s, err := introspect(ctx, tx, opts.Schema)
+		if err != nil {
+			return err
+		}
+		preData, postData = s.preDataSQL(opts.Schema), s.postDataSQL(opts.Schema)
+
+		for _, t := range s.tables {
+			entry := TableEntry{Name: t.name, DependsOn: t.dependsOn, DataFile: "data/" + t.name + ".csv"}
+			for _, c := range t.columns {
+				// Generated columns are recomputed on restore
+				if !c.generated {
+					entry.Columns = append(entry.Columns, c.name)
+				}
+			}
+			if err := copyOut(ctx, tx, opts.Schema, spool, &entry); err != nil {
+				return fmt.Errorf("table %s: %w", t.name, err)
+			}
+			manifest.Tables = append(manifest.Tables, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+
+	if err := writeArchive(w, spool, manifest, preData, postData, opts.Compress); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	return manifest, nil
+}
+
+// COPY one table into a spool file, counting rows and hashing the stream
+func copyOut(ctx context.Context, tx pgx.Tx, namespace, spool string, entry *TableEntry) error {
+	f, err := os.Create(spoolPath(spool, entry.Name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	sql := fmt.Sprintf("COPY %s (%s) TO STDOUT WITH (FORMAT csv)", pgx.Identifier{namespace, entry.Name}.Sanitize(), columnList(entry.Columns))
+	tag, err := tx.Conn().PgConn().CopyTo(ctx, io.MultiWriter(f, hash), sql)
+	if err != nil {
+		return err
+	}
+	entry.Rows = tag.RowsAffected()
+	entry.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return f.Close()
+}
+
+func writeArchive(w io.Writer, spool string, manifest *Manifest, preData, postData string, compress bool) error {
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeEntry(tw, manifestFile, encoded, manifest.CreatedAt); err != nil {
+		return err
+	}
+	if err := writeEntry(tw, schemaFile, []byte(preData), manifest.CreatedAt); err != nil {
+		return err
+	}
+	for _, t := range manifest.Tables {
+		f, err := os.Open(spoolPath(spool, t.Name))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: t.DataFile, Mode: 0o644, Size: info.Size(), ModTime: manifest.CreatedAt})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := writeEntry(tw, postDataFile, []byte(postData), manifest.CreatedAt); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Table names are hex-encoded so any identifier is a safe file name
+func spoolPath(spool, table string) string {
+	return filepath.Join(spool, hex.EncodeToString([]byte(table))+".csv")
+}
+
+func columnList(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
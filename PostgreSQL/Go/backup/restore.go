@@ -0,0 +1,133 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type RestoreOptions struct {
+	// Drop the archived tables first if they already exist
+	Clean bool
+}
+
+// Restore rebuilds the tables of an archive written by Backup in
+// foreign-key order and loads their data, all in one transaction. Each
+// table's checksum and row count are verified against the manifest before
+// the transaction commits.
+func Restore(ctx context.Context, pool *pgxpool.Pool, r io.Reader, opts RestoreOptions) (*Manifest, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("restore: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+	tr := tar.NewReader(r)
+
+	var manifest Manifest
+	encoded, err := readEntry(tr, manifestFile)
+	if err != nil {
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return nil, fmt.Errorf("restore: invalid manifest: %w", err)
+	}
+	if manifest.Version != formatVersion {
+		return nil, fmt.Errorf("restore: unsupported archive version %d", manifest.Version)
+	}
+	preData, err := readEntry(tr, schemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+
+	err = pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if opts.Clean {
+			for i := len(manifest.Tables) - 1; i >= 0; i-- {
+				name := pgx.Identifier{manifest.Schema, manifest.Tables[i].Name}.Sanitize()
+				if _, err := tx.Exec(ctx, "DROP TABLE IF EXISTS "+name+" CASCADE"); err != nil {
+					return err
+				}
+			}
+		}
+		if _, err := tx.Exec(ctx, string(preData)); err != nil {
+			return fmt.Errorf("schema: %w", err)
+		}
+
+		for _, t := range manifest.Tables {
+			if err := copyIn(ctx, tx, tr, manifest.Schema, t); err != nil {
+				return fmt.Errorf("table %s: %w", t.Name, err)
+			}
+		}
+
+		postData, err := readEntry(tr, postDataFile)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, string(postData)); err != nil {
+			return fmt.Errorf("post-data: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore: %w", err)
+	}
+	return &manifest, nil
+}
+
+func copyIn(ctx context.Context, tx pgx.Tx, tr *tar.Reader, namespace string, t TableEntry) error {
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("missing %s: %w", t.DataFile, err)
+	}
+	if hdr.Name != t.DataFile {
+		return fmt.Errorf("expected %s, found %s", t.DataFile, hdr.Name)
+	}
+
+	qualified := pgx.Identifier{namespace, t.Name}.Sanitize()
+	hash := sha256.New()
+	sql := fmt.Sprintf("COPY %s (%s) FROM STDIN WITH (FORMAT csv)", qualified, columnList(t.Columns))
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, io.TeeReader(tr, hash), sql)
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != t.SHA256 {
+		return fmt.Errorf("checksum mismatch: manifest %s, archive %s", t.SHA256, sum)
+	}
+	if tag.RowsAffected() != t.Rows {
+		return fmt.Errorf("loaded %d rows, manifest has %d", tag.RowsAffected(), t.Rows)
+	}
+	var count int64
+	if err := tx.QueryRow(ctx, "SELECT count(*) FROM "+qualified).Scan(&count); err != nil {
+		return err
+	}
+	if count != t.Rows {
+		return fmt.Errorf("table has %d rows, manifest has %d", count, t.Rows)
+	}
+	return nil
+}
+
+func readEntry(tr *tar.Reader, name string) ([]byte, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("missing %s: %w", name, err)
+	}
+	if hdr.Name != name {
+		return nil, fmt.Errorf("expected %s, found %s", name, hdr.Name)
+	}
+	return io.ReadAll(tr)
+}
@@ -0,0 +1,300 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type column struct {
+	name      string
+	typ       string
+	notNull   bool
+	def       *string
+	identity  string
+	generated bool
+	typeOID   uint32
+	enum      bool
+	sequence  *string
+}
+
+type table struct {
+	oid         uint32
+	name        string
+	columns     []column
+	constraints []string
+	indexes     []string
+	dependsOn   []string
+}
+
+type enumType struct {
+	name   string
+	labels []string
+}
+
+type schema struct {
+	tables []*table // in foreign-key order
+	enums  []enumType
+}
+
+// Read tables, columns, constraints, indexes and enum types of one namespace
+// from the catalogs, and order the tables so referenced tables come first.
+func introspect(ctx context.Context, tx pgx.Tx, namespace string) (*schema, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT c.oid, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relkind = 'r'
+		ORDER BY c.relname
+	`, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("list tables: %w", err)
+	}
+	var tables []*table
+	byOID := map[uint32]*table{}
+	for rows.Next() {
+		t := &table{}
+		if err := rows.Scan(&t.oid, &t.name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+		byOID[t.oid] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	enumOIDs := map[uint32]bool{}
+	for _, t := range tables {
+		if err := introspectTable(ctx, tx, namespace, t, byOID); err != nil {
+			return nil, fmt.Errorf("table %s: %w", t.name, err)
+		}
+		for _, c := range t.columns {
+			if c.enum {
+				enumOIDs[c.typeOID] = true
+			}
+		}
+	}
+
+	s := &schema{}
+	if s.tables, err = sortByDependencies(tables); err != nil {
+		return nil, err
+	}
+	if len(enumOIDs) > 0 {
+		oids := make([]int64, 0, len(enumOIDs))
+		for oid := range enumOIDs {
+			oids = append(oids, int64(oid))
+		}
+		rows, err := tx.Query(ctx, `
+			SELECT format_type(t.oid, NULL), array_agg(e.enumlabel::text ORDER BY e.enumsortorder)
+			FROM pg_type t
+			JOIN pg_enum e ON e.enumtypid = t.oid
+			WHERE t.oid::bigint = ANY($1::bigint[])
+			GROUP BY t.oid
+			ORDER BY 1
+		`, oids)
+		if err != nil {
+			return nil, fmt.Errorf("list enum types: %w", err)
+		}
+		for rows.Next() {
+			var e enumType
+			if err := rows.Scan(&e.name, &e.labels); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			s.enums = append(s.enums, e)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func introspectTable(ctx context.Context, tx pgx.Tx, namespace string, t *table, byOID map[uint32]*table) error {
+	qualified := pgx.Identifier{namespace, t.name}.Sanitize()
+
+	rows, err := tx.Query(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+			pg_get_expr(d.adbin, d.adrelid), a.attidentity::text, a.attgenerated <> '', a.atttypid, ty.typtype = 'e',
+			pg_get_serial_sequence($2, a.attname)
+		FROM pg_attribute a
+		JOIN pg_type ty ON ty.oid = a.atttypid
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum
+	`, t.oid, qualified)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c column
+		if err := rows.Scan(&c.name, &c.typ, &c.notNull, &c.def, &c.identity, &c.generated, &c.typeOID, &c.enum, &c.sequence); err != nil {
+			rows.Close()
+			return err
+		}
+		t.columns = append(t.columns, c)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Primary keys first so foreign keys elsewhere can reference them
+	rows, err = tx.Query(ctx, `
+		SELECT conname, pg_get_constraintdef(oid), confrelid
+		FROM pg_constraint
+		WHERE conrelid = $1
+		ORDER BY array_position(ARRAY['p', 'u', 'c', 'x', 'f']::"char"[], contype), conname
+	`, t.oid)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name, def string
+		var refOID uint32
+		if err := rows.Scan(&name, &def, &refOID); err != nil {
+			rows.Close()
+			return err
+		}
+		t.constraints = append(t.constraints, fmt.Sprintf("CONSTRAINT %s %s", pgx.Identifier{name}.Sanitize(), def))
+		if ref, ok := byOID[refOID]; ok && ref != t {
+			t.dependsOn = append(t.dependsOn, ref.name)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Indexes that back constraints are recreated by the constraints themselves
+	rows, err = tx.Query(ctx, `
+		SELECT pg_get_indexdef(i.indexrelid)
+		FROM pg_index i
+		WHERE i.indrelid = $1
+			AND NOT EXISTS (SELECT 1 FROM pg_constraint c WHERE c.conindid = i.indexrelid AND c.conrelid = i.indrelid)
+		ORDER BY i.indexrelid
+	`, t.oid)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var def string
+		if err := rows.Scan(&def); err != nil {
+			rows.Close()
+			return err
+		}
+		t.indexes = append(t.indexes, def)
+	}
+	return rows.Err()
+}
+
+// Kahn's algorithm, breaking ties by name so archives are deterministic.
+// Self-references are ignored: COPY checks them at the end of the statement.
+func sortByDependencies(tables []*table) ([]*table, error) {
+	remaining := map[string]*table{}
+	for _, t := range tables {
+		remaining[t.name] = t
+	}
+	var sorted []*table
+	for len(remaining) > 0 {
+		var ready []string
+		for name, t := range remaining {
+			blocked := false
+			for _, dep := range t.dependsOn {
+				if _, ok := remaining[dep]; ok {
+					blocked = true
+					break
+				}
+			}
+			if !blocked {
+				ready = append(ready, name)
+			}
+		}
+		if len(ready) == 0 {
+			var cycle []string
+			for name := range remaining {
+				cycle = append(cycle, name)
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("foreign-key cycle between tables %s", strings.Join(cycle, ", "))
+		}
+		sort.Strings(ready)
+		for _, name := range ready {
+			sorted = append(sorted, remaining[name])
+			delete(remaining, name)
+		}
+	}
+	return sorted, nil
+}
+
+// Statements run before the data is loaded: enum types, sequences and tables
+func (s *schema) preDataSQL(namespace string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CREATE SCHEMA IF NOT EXISTS %s;\n\n", pgx.Identifier{namespace}.Sanitize())
+	for _, e := range s.enums {
+		quoted := make([]string, len(e.labels))
+		for i, l := range e.labels {
+			quoted[i] = "'" + strings.ReplaceAll(l, "'", "''") + "'"
+		}
+		fmt.Fprintf(&b, "DO $$ BEGIN\n\tCREATE TYPE %s AS ENUM (%s);\nEXCEPTION WHEN duplicate_object THEN NULL;\nEND $$;\n\n", e.name, strings.Join(quoted, ", "))
+	}
+	for _, t := range s.tables {
+		for _, c := range t.columns {
+			if c.sequence != nil && c.identity == "" {
+				fmt.Fprintf(&b, "CREATE SEQUENCE IF NOT EXISTS %s;\n", *c.sequence)
+			}
+		}
+	}
+	for _, t := range s.tables {
+		qualified := pgx.Identifier{namespace, t.name}.Sanitize()
+		var defs []string
+		for _, c := range t.columns {
+			def := fmt.Sprintf("%s %s", pgx.Identifier{c.name}.Sanitize(), c.typ)
+			switch {
+			case c.identity == "a":
+				def += " GENERATED ALWAYS AS IDENTITY"
+			case c.identity == "d":
+				def += " GENERATED BY DEFAULT AS IDENTITY"
+			case c.generated:
+				def += " GENERATED ALWAYS AS (" + *c.def + ") STORED"
+			case c.def != nil:
+				def += " DEFAULT " + *c.def
+			}
+			if c.notNull {
+				def += " NOT NULL"
+			}
+			defs = append(defs, def)
+		}
+		defs = append(defs, t.constraints...)
+		fmt.Fprintf(&b, "\nCREATE TABLE %s (\n\t%s\n);\n", qualified, strings.Join(defs, ",\n\t"))
+		for _, c := range t.columns {
+			if c.sequence != nil && c.identity == "" {
+				fmt.Fprintf(&b, "ALTER SEQUENCE %s OWNED BY %s.%s;\n", *c.sequence, qualified, pgx.Identifier{c.name}.Sanitize())
+			}
+		}
+	}
+	return b.String()
+}
+
+// Statements run after the data is loaded: indexes and sequence positions
+func (s *schema) postDataSQL(namespace string) string {
+	var b strings.Builder
+	for _, t := range s.tables {
+		qualified := pgx.Identifier{namespace, t.name}.Sanitize()
+		for _, idx := range t.indexes {
+			fmt.Fprintf(&b, "%s;\n", idx)
+		}
+		for _, c := range t.columns {
+			if c.sequence == nil {
+				continue
+			}
+			col := pgx.Identifier{c.name}.Sanitize()
+			fmt.Fprintf(&b, "SELECT setval('%s', COALESCE(MAX(%s), 1), MAX(%s) IS NOT NULL) FROM %s;\n",
+				strings.ReplaceAll(*c.sequence, "'", "''"), col, col, qualified)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"example/diagnostics"
+)
+
+// Diagnostics thresholds and guard, read from the environment. Cancelling
+// and terminating backends stays disabled unless PG_ALLOW_SIGNALS is set.
+func diagnosticsOptions() diagnostics.Options {
+	defaults := diagnostics.DefaultOptions()
+	return diagnostics.Options{
+		LongTransaction:   envDuration("PG_LONG_TRANSACTION", defaults.LongTransaction),
+		IdleInTransaction: envDuration("PG_IDLE_IN_TRANSACTION", defaults.IdleInTransaction),
+		AllowSignals:      envBool("PG_ALLOW_SIGNALS", false),
+		MinSignalAge:      envDuration("PG_MIN_SIGNAL_AGE", defaults.MinSignalAge),
+	}
+}
+
+// Print blocking chains, long and idle transactions, and lock waits as JSON,
+// or cancel or terminate a backend:
+//
+//	go run . diagnose
+//	PG_ALLOW_SIGNALS=true go run . diagnose -cancel 4242
+func diagnoseCommand(ctx context.Context, args []string) {
+	opts := diagnosticsOptions()
+	flags := flag.NewFlagSet("diagnose", flag.ExitOnError)
+	flags.DurationVar(&opts.LongTransaction, "long", opts.LongTransaction, "report transactions open longer than this")
+	flags.DurationVar(&opts.IdleInTransaction, "idle", opts.IdleInTransaction, "report sessions idle in a transaction longer than this")
+	cancelPID := flags.Int("cancel", 0, "cancel the current query of this backend")
+	terminatePID := flags.Int("terminate", 0, "terminate this backend")
+	flags.Parse(args)
+
+	d := diagnostics.New(pool, opts)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	switch {
+	case *cancelPID != 0:
+		if err := d.Cancel(ctx, int32(*cancelPID)); err != nil {
+			log.Fatalf("Unable to cancel backend: %v\n", err)
+		}
+		log.Printf("Cancelled query of backend %d\n", *cancelPID)
+	case *terminatePID != 0:
+		if err := d.Terminate(ctx, int32(*terminatePID)); err != nil {
+			log.Fatalf("Unable to terminate backend: %v\n", err)
+		}
+		log.Printf("Terminated backend %d\n", *terminatePID)
+	default:
+		report, err := d.Report(ctx)
+		if err != nil {
+			log.Fatalf("Unable to collect diagnostics: %v\n", err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("Unable to encode diagnostics: %v\n", err)
+		}
+	}
+}
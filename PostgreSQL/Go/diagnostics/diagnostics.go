@@ -0,0 +1,270 @@
+// Package diagnostics reports lock contention and problem sessions from
+// pg_stat_activity and pg_locks, and can cancel or terminate a backend
+// behind an explicit guard.
+package diagnostics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var ErrNotAllowed = errors.New("diagnostics: action not allowed")
+
+type Session struct {
+	PID             int32         `json:"pid"`
+	User            string        `json:"user"`
+	Application     string        `json:"application"`
+	State           string        `json:"state"`
+	WaitEventType   string        `json:"wait_event_type,omitempty"`
+	WaitEvent       string        `json:"wait_event,omitempty"`
+	Query           string        `json:"query"`
+	TransactionAge  time.Duration `json:"transaction_age"`
+	StateAge        time.Duration `json:"state_age"`
+	BlockedBy       []int32       `json:"blocked_by,omitempty"`
+	BlockedSessions []*Session    `json:"blocked_sessions,omitempty"`
+	// Sessions waiting on this one that already appear above it in the
+	// chain, by PID: they block each other in a cycle
+	BlockedAbove []int32 `json:"blocked_above,omitempty"`
+}
+
+type RelationLockWaits struct {
+	Relation string `json:"relation"`
+	Mode     string `json:"mode"`
+	Waiting  int    `json:"waiting"`
+	Granted  int    `json:"granted"`
+}
+
+type Report struct {
+	GeneratedAt time.Time `json:"generated_at"`
+	// Sessions blocking others, each with the tree of sessions waiting on it
+	BlockingChains    []*Session          `json:"blocking_chains"`
+	LongTransactions  []*Session          `json:"long_transactions"`
+	IdleInTransaction []*Session          `json:"idle_in_transaction"`
+	LockWaits         []RelationLockWaits `json:"lock_waits"`
+}
+
+type Options struct {
+	// Transactions open longer than this are reported as long-running
+	LongTransaction time.Duration
+	// Sessions idle in a transaction longer than this are reported
+	IdleInTransaction time.Duration
+	// Allow Cancel and Terminate; off by default
+	AllowSignals bool
+	// Only signal backends whose transaction is at least this old
+	MinSignalAge time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		LongTransaction:   time.Minute,
+		IdleInTransaction: 30 * time.Second,
+		MinSignalAge:      time.Minute,
+	}
+}
+
+type Diagnostics struct {
+	pool *pgxpool.Pool
+	opts Options
+}
+
+func New(pool *pgxpool.Pool, opts Options) *Diagnostics {
+	return &Diagnostics{pool: pool, opts: opts}
+}
+
+const sessionColumns = `
+	pid, COALESCE(usename, ''), COALESCE(application_name, ''), COALESCE(state, ''),
+	COALESCE(wait_event_type, ''), COALESCE(wait_event, ''), COALESCE(query, ''),
+	COALESCE(extract(epoch FROM now() - xact_start), 0)::float8,
+	COALESCE(extract(epoch FROM now() - state_change), 0)::float8,
+	pg_blocking_pids(pid)
+`
+
+func (d *Diagnostics) sessions(ctx context.Context, where string, args ...interface{}) ([]*Session, error) {
+	rows, err := d.pool.Query(ctx, "SELECT "+sessionColumns+" FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND "+where+" ORDER BY xact_start NULLS LAST", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s := &Session{}
+		var transactionAge, stateAge float64
+		err := rows.Scan(&s.PID, &s.User, &s.Application, &s.State, &s.WaitEventType, &s.WaitEvent,
+			&s.Query, &transactionAge, &stateAge, &s.BlockedBy)
+		if err != nil {
+			return nil, err
+		}
+		s.TransactionAge = time.Duration(transactionAge * float64(time.Second))
+		s.StateAge = time.Duration(stateAge * float64(time.Second))
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Blocking chains built from pg_blocking_pids. Each root is a session that
+// blocks others without being blocked itself; a session blocked by several
+// others appears under each of them. Every chain is a tree: a session that
+// would be nested under itself is listed in BlockedAbove instead.
+func (d *Diagnostics) BlockingChains(ctx context.Context) ([]*Session, error) {
+	sessions, err := d.sessions(ctx, `
+		(cardinality(pg_blocking_pids(pid)) > 0
+			OR pid IN (SELECT unnest(pg_blocking_pids(a.pid)) FROM pg_stat_activity a))
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("blocking chains: %w", err)
+	}
+	return chains(sessions), nil
+}
+
+func chains(sessions []*Session) []*Session {
+	byPID := map[int32]*Session{}
+	for _, s := range sessions {
+		byPID[s.PID] = s
+	}
+	blocked := map[int32][]*Session{}
+	for _, s := range sessions {
+		for _, pid := range s.BlockedBy {
+			if _, ok := byPID[pid]; ok {
+				blocked[pid] = append(blocked[pid], s)
+			}
+		}
+	}
+
+	reached := map[int32]bool{}
+	above := map[int32]bool{}
+	var chain func(s *Session) *Session
+	chain = func(s *Session) *Session {
+		node := *s
+		reached[s.PID], above[s.PID] = true, true
+		for _, b := range blocked[s.PID] {
+			if above[b.PID] {
+				node.BlockedAbove = append(node.BlockedAbove, b.PID)
+			} else {
+				node.BlockedSessions = append(node.BlockedSessions, chain(b))
+			}
+		}
+		delete(above, s.PID)
+		return &node
+	}
+
+	var roots []*Session
+	for _, s := range sessions {
+		if len(s.BlockedBy) == 0 {
+			roots = append(roots, chain(s))
+		}
+	}
+	// Sessions that block each other in a cycle (a deadlock about to be
+	// detected) and are not under a root start chains of their own
+	for _, s := range sessions {
+		if !reached[s.PID] {
+			roots = append(roots, chain(s))
+		}
+	}
+	return roots
+}
+
+func (d *Diagnostics) LongTransactions(ctx context.Context) ([]*Session, error) {
+	sessions, err := d.sessions(ctx, "xact_start < now() - make_interval(secs => $1)", d.opts.LongTransaction.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("long transactions: %w", err)
+	}
+	return sessions, nil
+}
+
+func (d *Diagnostics) IdleInTransaction(ctx context.Context) ([]*Session, error) {
+	sessions, err := d.sessions(ctx, "state IN ('idle in transaction', 'idle in transaction (aborted)') AND state_change < now() - make_interval(secs => $1)", d.opts.IdleInTransaction.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("idle in transaction: %w", err)
+	}
+	return sessions, nil
+}
+
+// Lock requests per relation and mode where at least one is waiting
+func (d *Diagnostics) LockWaits(ctx context.Context) ([]RelationLockWaits, error) {
+	rows, err := d.pool.Query(ctx, `
+		SELECT relation::regclass::text, mode,
+			count(*) FILTER (WHERE NOT granted), count(*) FILTER (WHERE granted)
+		FROM pg_locks
+		WHERE relation IS NOT NULL AND database = (SELECT oid FROM pg_database WHERE datname = current_database())
+		GROUP BY relation, mode
+		HAVING count(*) FILTER (WHERE NOT granted) > 0
+		ORDER BY 3 DESC, 1
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("lock waits: %w", err)
+	}
+	defer rows.Close()
+
+	var waits []RelationLockWaits
+	for rows.Next() {
+		var w RelationLockWaits
+		if err := rows.Scan(&w.Relation, &w.Mode, &w.Waiting, &w.Granted); err != nil {
+			return nil, err
+		}
+		waits = append(waits, w)
+	}
+	return waits, rows.Err()
+}
+
+func (d *Diagnostics) Report(ctx context.Context) (*Report, error) {
+	r := &Report{GeneratedAt: time.Now().UTC()}
+	var err error
+	if r.BlockingChains, err = d.BlockingChains(ctx); err != nil {
+		return nil, err
+	}
+	if r.LongTransactions, err = d.LongTransactions(ctx); err != nil {
+		return nil, err
+	}
+	if r.IdleInTransaction, err = d.IdleInTransaction(ctx); err != nil {
+		return nil, err
+	}
+	if r.LockWaits, err = d.LockWaits(ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Cancel the current query of pid with pg_cancel_backend
+func (d *Diagnostics) Cancel(ctx context.Context, pid int32) error {
+	return d.signal(ctx, "pg_cancel_backend", pid)
+}
+
+// Terminate the session pid with pg_terminate_backend
+func (d *Diagnostics) Terminate(ctx context.Context, pid int32) error {
+	return d.signal(ctx, "pg_terminate_backend", pid)
+}
+
+// Signals are refused unless enabled, and only reach client backends of the
+// current database whose transaction is older than MinSignalAge. The check
+// and the signal run in one statement so the target cannot change between.
+func (d *Diagnostics) signal(ctx context.Context, fn string, pid int32) error {
+	if !d.opts.AllowSignals {
+		return fmt.Errorf("%w: signals are disabled", ErrNotAllowed)
+	}
+	var signalled *bool
+	err := d.pool.QueryRow(ctx, `
+		SELECT `+fn+`(pid)
+		FROM pg_stat_activity
+		WHERE pid = $1
+			AND pid <> pg_backend_pid()
+			AND backend_type = 'client backend'
+			AND datname = current_database()
+			AND xact_start < now() - make_interval(secs => $2)
+	`, pid, d.opts.MinSignalAge.Seconds()).Scan(&signalled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("%w: backend %d is not an eligible client session", ErrNotAllowed, pid)
+	}
+	if err != nil {
+		return fmt.Errorf("diagnostics: %s(%d): %w", fn, pid, err)
+	}
+	if signalled == nil || !*signalled {
+		return fmt.Errorf("diagnostics: %s(%d) was not delivered", fn, pid)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package diagnostics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Register the report and the signal actions on mux under prefix:
+//
+//	GET  prefix            the full Report as JSON
+//	POST prefix/cancel     ?pid=N, pg_cancel_backend
+//	POST prefix/terminate  ?pid=N, pg_terminate_backend
+//
+// The actions answer 403 unless Options.AllowSignals is set.
+func (d *Diagnostics) Register(mux *http.ServeMux, prefix string) {
+	mux.HandleFunc(prefix, d.reportHandler)
+	mux.HandleFunc(prefix+"/cancel", d.signalHandler(d.Cancel))
+	mux.HandleFunc(prefix+"/terminate", d.signalHandler(d.Terminate))
+}
+
+func (d *Diagnostics) reportHandler(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+	defer cancel()
+
+	report, err := d.Report(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(body, '\n'))
+}
+
+func (d *Diagnostics) signalHandler(action func(context.Context, int32) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		pid, err := strconv.ParseInt(req.URL.Query().Get("pid"), 10, 32)
+		if err != nil {
+			http.Error(w, "invalid pid", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		err = action(ctx, int32(pid))
+		switch {
+		case errors.Is(err, ErrNotAllowed):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
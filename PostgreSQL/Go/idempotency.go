@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Idempotency key settings, read from the environment
+var (
+	idempotencyKeyTTL        = envDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+	idempotencyPurgeInterval = envDuration("IDEMPOTENCY_PURGE_INTERVAL", time.Hour)
+)
+
+var ErrIdempotencyConflict = errors.New("idempotency key reused with a different payload")
+
+const idempotencySchema = `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key TEXT PRIMARY KEY,
+		request_hash BYTEA NOT NULL,
+		response JSONB,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+`
+
+// Create an order at most once per key. Repeating a key with the same
+// payload returns the original order; repeating it with a different payload
+// returns ErrIdempotencyConflict. An expired key is treated as new.
+//
+// Concurrent requests with the same key serialize on the key's primary-key
+// index: the second INSERT waits for the first transaction and then sees
+// its stored response.
+func CreateOrder(ctx context.Context, key string, order Order) (Order, error) {
+	payload, err := json.Marshal(struct {
+		UserID  int    `json:"user_id"`
+		Product string `json:"product"`
+		Amount  int    `json:"amount"`
+	}{order.UserID, order.Product, order.Amount})
+	if err != nil {
+		return Order{}, err
+	}
+	hash := sha256.Sum256(payload)
+
+	var created Order
+	err = executeTx(ctx, opWrite, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO idempotency_keys (key, request_hash, expires_at)
+			VALUES ($1, $2, now() + make_interval(secs => $3))
+			ON CONFLICT (key) DO UPDATE
+				SET request_hash = EXCLUDED.request_hash, response = NULL,
+					created_at = now(), expires_at = EXCLUDED.expires_at
+				WHERE idempotency_keys.expires_at <= now()
+		`, key, hash[:], idempotencyKeyTTL.Seconds())
+		if err != nil {
+			return err
+		}
+
+		if tag.RowsAffected() == 0 {
+			var storedHash []byte
+			var response *Order
+			err := tx.QueryRow(ctx, "SELECT request_hash, response FROM idempotency_keys WHERE key = $1", key).Scan(&storedHash, &response)
+			if err != nil {
+				return err
+			}
+			if string(storedHash) != string(hash[:]) {
+				return fmt.Errorf("%w: %q", ErrIdempotencyConflict, key)
+			}
+			if response == nil {
+				return fmt.Errorf("idempotency key %q has no stored response", key)
+			}
+			created = *response
+			return nil
+		}
+
+		created = order
+		err = tx.QueryRow(ctx, "INSERT INTO orders (user_id, product, amount) VALUES ($1, $2, $3) RETURNING id",
+			order.UserID, order.Product, order.Amount).Scan(&created.ID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE idempotency_keys SET response = $2 WHERE key = $1", key, created)
+		return err
+	})
+	if err != nil {
+		return Order{}, err
+	}
+	return created, nil
+}
+
+// Delete expired keys
+func purgeExpiredIdempotencyKeys(ctx context.Context) (int64, error) {
+	tag, err := executeExec(ctx, opWrite, "DELETE FROM idempotency_keys WHERE expires_at <= now()")
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// Purge expired keys every IDEMPOTENCY_PURGE_INTERVAL until ctx is done.
+// Run it from a leader-election OnElected callback so one replica purges.
+func runIdempotencyKeyPurger(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+	for {
+		n, err := purgeExpiredIdempotencyKeys(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Unable to purge idempotency keys: %v\n", err)
+		} else if n > 0 {
+			log.Printf("Purged %d expired idempotency keys\n", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Elector runs leader election among replicas that share an advisory-lock
+// key. At most one replica holds the lock, and therefore leadership, at a time.
+type Elector struct {
+	locker *Locker
+	key    int64
+
+	// RetryInterval is how often a follower tries to take the lock.
+	RetryInterval time.Duration
+	// RenewInterval is how often the leader verifies it still holds the lock.
+	RenewInterval time.Duration
+	// OnElected is started in its own goroutine when leadership is gained.
+	// ctx is cancelled as soon as leadership is lost.
+	OnElected func(ctx context.Context)
+	// OnDemoted is called after leadership is lost, with the reason.
+	OnDemoted func(err error)
+	// OnError is called for errors while campaigning, other than ErrNotAcquired.
+	OnError func(err error)
+
+	leader atomic.Bool
+}
+
+// NewElector returns an Elector campaigning for key.
+func (l *Locker) NewElector(key int64) *Elector {
+	return &Elector{
+		locker:        l,
+		key:           key,
+		RetryInterval: 5 * time.Second,
+		RenewInterval: 5 * time.Second,
+	}
+}
+
+// IsLeader reports whether this replica currently holds leadership.
+func (e *Elector) IsLeader() bool {
+	return e.leader.Load()
+}
+
+// Run campaigns for leadership until ctx is done. It returns ctx.Err().
+func (e *Elector) Run(ctx context.Context) error {
+	for {
+		held, err := e.locker.TryLock(ctx, e.key)
+		switch {
+		case err == nil:
+			e.lead(ctx, held)
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case !errors.Is(err, ErrNotAcquired) && e.OnError != nil:
+			e.OnError(err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.RetryInterval):
+		}
+	}
+}
+
+func (e *Elector) lead(ctx context.Context, held *SessionLock) {
+	leaderCtx, cancel := context.WithCancel(ctx)
+	e.leader.Store(true)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if e.OnElected != nil {
+			e.OnElected(leaderCtx)
+		}
+	}()
+
+	ticker := time.NewTicker(e.RenewInterval)
+	var reason error
+	for reason == nil {
+		select {
+		case <-ctx.Done():
+			reason = ctx.Err()
+		case <-ticker.C:
+			renewCtx, cancelRenew := context.WithTimeout(ctx, e.RenewInterval)
+			reason = held.Renew(renewCtx)
+			cancelRenew()
+		}
+	}
+	ticker.Stop()
+
+	e.leader.Store(false)
+	cancel()
+	<-done
+
+	unlockCtx, cancelUnlock := context.WithTimeout(context.Background(), e.RenewInterval)
+	held.Unlock(unlockCtx)
+	cancelUnlock()
+
+	if e.OnDemoted != nil {
+		e.OnDemoted(reason)
+	}
+}
@@ -0,0 +1,179 @@
+// Package lock provides distributed locks on top of PostgreSQL advisory locks.
+//
+// Session-scoped locks are held by a dedicated pooled connection until they
+// are released or the connection dies. Transaction-scoped locks are released
+// automatically when the surrounding transaction commits or rolls back.
+package lock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var (
+	// ErrNotAcquired is returned by the Try variants when another session holds the lock.
+	ErrNotAcquired = errors.New("lock: not acquired")
+	// ErrLockLost is returned when a held session lock is no longer granted.
+	ErrLockLost = errors.New("lock: lock lost")
+	// ErrReleased is returned when a released lock is used again.
+	ErrReleased = errors.New("lock: already released")
+)
+
+// Key derives a stable advisory-lock key from a name, so replicas agree on
+// the key without coordinating numeric constants.
+func Key(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// Locker hands out advisory locks backed by a connection pool.
+type Locker struct {
+	pool *pgxpool.Pool
+}
+
+// New returns a Locker that acquires connections from pool.
+func New(pool *pgxpool.Pool) *Locker {
+	return &Locker{pool: pool}
+}
+
+// SessionLock is a session-scoped advisory lock pinned to one connection.
+type SessionLock struct {
+	key int64
+
+	mu   sync.Mutex
+	conn *pgxpool.Conn
+}
+
+// Lock blocks until the advisory lock for key is acquired or ctx is done.
+func (l *Locker) Lock(ctx context.Context, key int64) (*SessionLock, error) {
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("lock: unable to acquire connection: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		// A cancelled pg_advisory_lock leaves the connection in an unknown
+		// state, so it is closed rather than returned to the pool.
+		conn.Conn().Close(context.Background())
+		conn.Release()
+		return nil, fmt.Errorf("lock: unable to lock %d: %w", key, err)
+	}
+	return &SessionLock{key: key, conn: conn}, nil
+}
+
+// TryLock acquires the advisory lock for key without waiting. It returns
+// ErrNotAcquired if another session holds it.
+func (l *Locker) TryLock(ctx context.Context, key int64) (*SessionLock, error) {
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("lock: unable to acquire connection: %w", err)
+	}
+	var acquired bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("lock: unable to try lock %d: %w", key, err)
+	}
+	if !acquired {
+		conn.Release()
+		return nil, ErrNotAcquired
+	}
+	return &SessionLock{key: key, conn: conn}, nil
+}
+
+// Key returns the advisory-lock key held by s.
+func (s *SessionLock) Key() int64 {
+	return s.key
+}
+
+// Renew checks that the holding connection is alive and the lock is still
+// granted to it. Advisory locks have no server-side expiry, so the lease
+// lasts exactly as long as the connection; Renew also keeps that connection
+// from being reaped as idle by proxies between checks.
+func (s *SessionLock) Renew(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return ErrReleased
+	}
+	var held bool
+	err := s.conn.QueryRow(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory'
+				AND pid = pg_backend_pid()
+				AND granted
+				AND classid = (($1::bigint >> 32) & 4294967295)::bigint::oid
+				AND objid = ($1::bigint & 4294967295)::bigint::oid
+				AND objsubid = 1
+		)
+	`, s.key).Scan(&held)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrLockLost, err)
+	}
+	if !held {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// Unlock releases the lock and returns the connection to the pool.
+func (s *SessionLock) Unlock(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return ErrReleased
+	}
+	conn := s.conn
+	s.conn = nil
+	defer conn.Release()
+
+	var released bool
+	if err := conn.QueryRow(ctx, "SELECT pg_advisory_unlock($1)", s.key).Scan(&released); err != nil {
+		// Closing the connection is the only other way to drop the lock.
+		conn.Conn().Close(context.Background())
+		return fmt.Errorf("lock: unable to unlock %d: %w", s.key, err)
+	}
+	if !released {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// LockTx blocks until the transaction-scoped advisory lock for key is
+// acquired. The lock is released when tx ends.
+func LockTx(ctx context.Context, tx pgx.Tx, key int64) error {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", key); err != nil {
+		return fmt.Errorf("lock: unable to lock %d in transaction: %w", key, err)
+	}
+	return nil
+}
+
+// TryLockTx acquires the transaction-scoped advisory lock for key without
+// waiting. It returns ErrNotAcquired if another session holds it.
+func TryLockTx(ctx context.Context, tx pgx.Tx, key int64) error {
+	var acquired bool
+	if err := tx.QueryRow(ctx, "SELECT pg_try_advisory_xact_lock($1)", key).Scan(&acquired); err != nil {
+		return fmt.Errorf("lock: unable to try lock %d in transaction: %w", key, err)
+	}
+	if !acquired {
+		return ErrNotAcquired
+	}
+	return nil
+}
+
+// WithTxLock runs fn in a transaction that holds the advisory lock for key.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+func (l *Locker) WithTxLock(ctx context.Context, key int64, fn func(pgx.Tx) error) error {
+	return l.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if err := LockTx(ctx, tx, key); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
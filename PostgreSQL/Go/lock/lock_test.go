@@ -0,0 +1,47 @@
+package lock
+
+import (
+	"context"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testPool connects to the database in PG_TEST_DSN, skipping the test when
+// it is not set.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("PG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PG_TEST_DSN not set")
+	}
+	pool, err := pgxpool.Connect(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestRenewKeys(t *testing.T) {
+	pool := testPool(t)
+	locker := New(pool)
+	ctx := context.Background()
+
+	// Negative keys have the top bit set, which pg_locks reports as a
+	// classid above 2^31
+	for _, key := range []int64{1, -1, math.MinInt64, math.MaxInt64, Key("scheduler"), Key("maintenance")} {
+		l, err := locker.TryLock(ctx, key)
+		if err != nil {
+			t.Fatalf("TryLock(%d): %v", key, err)
+		}
+		if err := l.Renew(ctx); err != nil {
+			t.Errorf("Renew(%d): %v", key, err)
+		}
+		if err := l.Unlock(ctx); err != nil {
+			t.Fatalf("Unlock(%d): %v", key, err)
+		}
+	}
+}
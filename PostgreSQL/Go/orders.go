@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type Order struct {
+	ID      int    `json:"id"`
+	UserID  int    `json:"user_id"`
+	Product string `json:"product"`
+	Amount  int    `json:"amount"`
+}
+
+// Order lifecycle
+type OrderStatus string
+
+const (
+	OrderPending  OrderStatus = "pending"
+	OrderPaid     OrderStatus = "paid"
+	OrderShipped  OrderStatus = "shipped"
+	OrderRefunded OrderStatus = "refunded"
+)
+
+// Allowed transitions; every other pair is rejected
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending: {OrderPaid},
+	OrderPaid:    {OrderShipped, OrderRefunded},
+	OrderShipped: {OrderRefunded},
+}
+
+var (
+	ErrOrderNotFound     = errors.New("order not found")
+	ErrInvalidTransition = errors.New("invalid order status transition")
+	ErrStatusConflict    = errors.New("order status changed concurrently")
+)
+
+// Created with the tables; safe to run repeatedly
+const orderLifecycleSchema = `
+	DO $$ BEGIN
+		CREATE TYPE order_status AS ENUM ('pending', 'paid', 'shipped', 'refunded');
+	EXCEPTION WHEN duplicate_object THEN NULL;
+	END $$;
+
+	ALTER TABLE orders ADD COLUMN IF NOT EXISTS status order_status NOT NULL DEFAULT 'pending';
+
+	CREATE TABLE IF NOT EXISTS order_events (
+		id BIGSERIAL PRIMARY KEY,
+		order_id INT NOT NULL REFERENCES orders(id) ON DELETE CASCADE,
+		from_status order_status NOT NULL,
+		to_status order_status NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS idx_order_events_order_id ON order_events(order_id);
+`
+
+func canTransition(from, to OrderStatus) bool {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Move an order from one status to another. The UPDATE only matches while
+// the order is still in the expected status, so concurrent transitions
+// cannot both succeed; the event is recorded in the same transaction.
+func TransitionOrder(ctx context.Context, id int, from, to OrderStatus) error {
+	if !canTransition(from, to) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+	return executeTx(ctx, opWrite, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, "UPDATE orders SET status = $3 WHERE id = $1 AND status = $2", id, string(from), string(to))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			var current string
+			err := tx.QueryRow(ctx, "SELECT status::text FROM orders WHERE id = $1", id).Scan(&current)
+			if errors.Is(err, pgx.ErrNoRows) {
+				return fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+			}
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: order %d is %s, expected %s", ErrStatusConflict, id, current, from)
+		}
+
+		_, err = tx.Exec(ctx, "INSERT INTO order_events (order_id, from_status, to_status) VALUES ($1, $2, $3)", id, string(from), string(to))
+		return err
+	})
+}
+
+func getOrderStatus(ctx context.Context, id int) (OrderStatus, error) {
+	rows, err := executeQuery(ctx, opRead, "SELECT status::text FROM orders WHERE id = $1", id)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: %d", ErrOrderNotFound, id)
+	}
+	var status string
+	if err := rows.Scan(&status); err != nil {
+		return "", err
+	}
+	return OrderStatus(status), rows.Err()
+}
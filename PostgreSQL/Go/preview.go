@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// When a previewed statement is allowed to commit
+type PreviewOptions struct {
+	// Column identifying rows in the diff; defaults to id
+	Key string
+	// The caller has reviewed the preview and wants it applied
+	Confirm bool
+	// Commit without confirmation when at most this many rows are affected;
+	// 0 never commits without confirmation
+	MaxAffected int
+}
+
+type FieldChange struct {
+	Column string
+	Before interface{}
+	After  interface{}
+}
+
+// Before and after images of one row; After is nil for deletes
+type RowChange struct {
+	Key     interface{}
+	Before  map[string]interface{}
+	After   map[string]interface{}
+	Changes []FieldChange
+}
+
+type Preview struct {
+	Statement string
+	Affected  int
+	Rows      []RowChange
+	Committed bool
+}
+
+// Preview an UPDATE of table. The statement runs in a transaction that is
+// rolled back unless opts allow it to commit, so the diff shows exactly what
+// would change.
+func previewUpdate(ctx context.Context, table, set, where string, args []interface{}, opts PreviewOptions) (*Preview, error) {
+	statement := fmt.Sprintf("UPDATE %s AS t SET %s WHERE %s RETURNING to_jsonb(t.*)", pgx.Identifier{table}.Sanitize(), set, where)
+	return runPreview(ctx, table, where, statement, args, opts)
+}
+
+// Preview a DELETE from table; see previewUpdate
+func previewDelete(ctx context.Context, table, where string, args []interface{}, opts PreviewOptions) (*Preview, error) {
+	statement := fmt.Sprintf("DELETE FROM %s AS t WHERE %s RETURNING to_jsonb(t.*)", pgx.Identifier{table}.Sanitize(), where)
+	return runPreview(ctx, table, where, statement, args, opts)
+}
+
+func runPreview(ctx context.Context, table, where, statement string, args []interface{}, opts PreviewOptions) (*Preview, error) {
+	if opts.Key == "" {
+		opts.Key = "id"
+	}
+	preview := &Preview{Statement: statement}
+
+	ctx, cancel := context.WithTimeout(ctx, opWrite.deadline)
+	defer cancel()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, classifyError(ctx, opWrite, err)
+	}
+	defer tx.Rollback(context.Background())
+	if err := applyServerTimeouts(ctx, tx, opWrite); err != nil {
+		return nil, classifyError(ctx, opWrite, err)
+	}
+
+	// Lock the rows first so the before images cannot change underneath us
+	before, err := collectImages(ctx, tx, fmt.Sprintf("SELECT to_jsonb(t.*) FROM %s AS t WHERE %s FOR UPDATE", pgx.Identifier{table}.Sanitize(), where), args)
+	if err != nil {
+		return nil, classifyError(ctx, opWrite, err)
+	}
+	after, err := collectImages(ctx, tx, statement, args)
+	if err != nil {
+		return nil, classifyError(ctx, opWrite, err)
+	}
+	preview.Affected = len(after)
+
+	byKey := map[string]map[string]interface{}{}
+	for _, row := range after {
+		byKey[fmt.Sprint(row[opts.Key])] = row
+	}
+	for _, row := range before {
+		change := RowChange{Key: row[opts.Key], Before: row}
+		if !strings.HasPrefix(statement, "DELETE") {
+			change.After = byKey[fmt.Sprint(row[opts.Key])]
+		}
+		change.Changes = diffImages(change.Before, change.After)
+		preview.Rows = append(preview.Rows, change)
+	}
+
+	if opts.Confirm || (opts.MaxAffected > 0 && preview.Affected <= opts.MaxAffected) {
+		if err := tx.Commit(ctx); err != nil {
+			return nil, classifyError(ctx, opWrite, err)
+		}
+		preview.Committed = true
+	}
+	return preview, nil
+}
+
+func collectImages(ctx context.Context, tx pgx.Tx, query string, args []interface{}) ([]map[string]interface{}, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var images []map[string]interface{}
+	for rows.Next() {
+		var image map[string]interface{}
+		if err := rows.Scan(&image); err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, rows.Err()
+}
+
+func diffImages(before, after map[string]interface{}) []FieldChange {
+	columns := make([]string, 0, len(before))
+	for column := range before {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	var changes []FieldChange
+	for _, column := range columns {
+		var next interface{}
+		if after != nil {
+			next = after[column]
+		}
+		if after == nil || !reflect.DeepEqual(before[column], next) {
+			changes = append(changes, FieldChange{Column: column, Before: before[column], After: next})
+		}
+	}
+	return changes
+}
+
+// Render the preview as a diff, one line per changed column
+func (p *Preview) String() string {
+	var b strings.Builder
+	state := "rolled back"
+	if p.Committed {
+		state = "committed"
+	}
+	fmt.Fprintf(&b, "%d rows affected (%s)\n", p.Affected, state)
+	for _, row := range p.Rows {
+		if row.After == nil {
+			fmt.Fprintf(&b, "- row %v deleted\n", row.Key)
+		}
+		for _, c := range row.Changes {
+			if row.After == nil {
+				fmt.Fprintf(&b, "    %s: %v\n", c.Column, c.Before)
+			} else {
+				fmt.Fprintf(&b, "~ row %v %s: %v -> %v\n", row.Key, c.Column, c.Before, c.After)
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"example/lock"
+
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrReferralCycle = errors.New("referral would create a cycle")
+
+// Created with the tables; safe to run repeatedly
+const referralSchema = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS referred_by INT REFERENCES users(id) ON DELETE SET NULL;
+	CREATE INDEX IF NOT EXISTS idx_users_referred_by ON users(referred_by);
+`
+
+// One user in a referral tree. OrderTotal is the user's own order amount;
+// SubtreeTotal adds the orders of everyone below them in the tree.
+type ReferralNode struct {
+	User         User
+	ReferredBy   *int
+	Depth        int
+	OrderTotal   int64
+	SubtreeTotal int64
+	Children     []*ReferralNode
+}
+
+// Walk the tree depth-first, parents before children
+func (n *ReferralNode) Walk(fn func(*ReferralNode)) {
+	fn(n)
+	for _, child := range n.Children {
+		child.Walk(fn)
+	}
+}
+
+// Set who referred a user; referrer 0 clears it. Referrals that would make
+// the user their own ancestor are rejected with ErrReferralCycle. Changes
+// serialize on an advisory lock so two concurrent updates cannot close a
+// cycle between them.
+func setReferrer(ctx context.Context, id, referrer int) error {
+	return executeTx(ctx, opWrite, func(tx pgx.Tx) error {
+		if err := lock.LockTx(ctx, tx, lock.Key("referrals")); err != nil {
+			return err
+		}
+		var referredBy *int
+		if referrer != 0 {
+			var cycle bool
+			err := tx.QueryRow(ctx, `
+				WITH RECURSIVE chain AS (
+					SELECT id, referred_by, ARRAY[id] AS path FROM users WHERE id = $1
+					UNION ALL
+					SELECT u.id, u.referred_by, c.path || u.id
+					FROM users u JOIN chain c ON u.id = c.referred_by
+					WHERE NOT u.id = ANY(c.path)
+				)
+				SELECT EXISTS (SELECT 1 FROM chain WHERE id = $2)
+			`, referrer, id).Scan(&cycle)
+			if err != nil {
+				return err
+			}
+			if cycle {
+				return fmt.Errorf("%w: user %d is referred by user %d", ErrReferralCycle, referrer, id)
+			}
+			referredBy = &referrer
+		}
+		tag, err := tx.Exec(ctx, "UPDATE users SET referred_by = $2 WHERE id = $1", id, referredBy)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// The referral subtree below a user, down to maxDepth levels (0 for no
+// limit), with own and per-subtree order totals. The path array stops the
+// recursion if existing data already contains a cycle.
+func referralSubtree(ctx context.Context, id, maxDepth int) (*ReferralNode, error) {
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT id, name, email, age, referred_by, 0 AS depth, ARRAY[id] AS path
+			FROM users WHERE id = $1
+			UNION ALL
+			SELECT u.id, u.name, u.email, u.age, u.referred_by, t.depth + 1, t.path || u.id
+			FROM users u JOIN tree t ON u.referred_by = t.id
+			WHERE NOT u.id = ANY(t.path) AND ($2::int = 0 OR t.depth < $2::int)
+		), own AS (
+			SELECT t.id, COALESCE(sum(o.amount), 0) AS total
+			FROM tree t LEFT JOIN orders o ON o.user_id = t.id
+			GROUP BY t.id
+		)
+		SELECT t.id, t.name, t.email, t.age, t.referred_by, t.depth, own.total,
+			(SELECT sum(d_own.total) FROM tree d JOIN own d_own ON d_own.id = d.id WHERE t.id = ANY(d.path))::bigint
+		FROM tree t JOIN own ON own.id = t.id
+		ORDER BY t.depth, t.id
+	`
+	nodes, err := queryReferralNodes(ctx, query, id, maxDepth)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+
+	byID := map[int]*ReferralNode{}
+	for _, n := range nodes {
+		byID[n.User.ID] = n
+		if n.Depth > 0 {
+			parent := byID[*n.ReferredBy]
+			parent.Children = append(parent.Children, n)
+		}
+	}
+	return nodes[0], nil
+}
+
+// Everyone below a user in the referral tree
+func referralDescendants(ctx context.Context, id int) (*ReferralNode, error) {
+	return referralSubtree(ctx, id, 0)
+}
+
+// The chain of referrers above a user, returned as a tree rooted at the
+// earliest referrer with the user as the single leaf. SubtreeTotal counts
+// only the orders along the chain.
+func referralAncestors(ctx context.Context, id int) (*ReferralNode, error) {
+	query := `
+		WITH RECURSIVE chain AS (
+			SELECT id, name, email, age, referred_by, 0 AS distance, ARRAY[id] AS path
+			FROM users WHERE id = $1
+			UNION ALL
+			SELECT u.id, u.name, u.email, u.age, u.referred_by, c.distance + 1, c.path || u.id
+			FROM users u JOIN chain c ON u.id = c.referred_by
+			WHERE NOT u.id = ANY(c.path)
+		)
+		SELECT c.id, c.name, c.email, c.age, c.referred_by, max(c.distance) OVER () - c.distance,
+			COALESCE((SELECT sum(o.amount) FROM orders o WHERE o.user_id = c.id), 0), 0
+		FROM chain c
+		ORDER BY c.distance DESC
+	`
+	nodes, err := queryReferralNodes(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, pgx.ErrNoRows
+	}
+	for i := len(nodes) - 1; i > 0; i-- {
+		nodes[i-1].Children = []*ReferralNode{nodes[i]}
+		nodes[i].SubtreeTotal += nodes[i].OrderTotal
+		nodes[i-1].SubtreeTotal = nodes[i].SubtreeTotal
+	}
+	nodes[0].SubtreeTotal += nodes[0].OrderTotal
+	return nodes[0], nil
+}
+
+func queryReferralNodes(ctx context.Context, query string, args ...interface{}) ([]*ReferralNode, error) {
+	rows, err := executeQuery(ctx, opRead, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []*ReferralNode
+	for rows.Next() {
+		n := &ReferralNode{}
+		var age *int
+		err := rows.Scan(&n.User.ID, &n.User.Name, &n.User.Email, &age, &n.ReferredBy, &n.Depth, &n.OrderTotal, &n.SubtreeTotal)
+		if err != nil {
+			return nil, err
+		}
+		if age != nil {
+			n.User.Age = *age
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, rows.Err()
+}
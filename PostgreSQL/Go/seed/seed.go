@@ -0,0 +1,203 @@
+// Package seed generates reproducible synthetic users and orders.
+//
+// The same Config and Seed always produce the same Dataset, and the dataset
+// can be written as JSON Lines so the MongoDB and Elasticsearch examples load
+// exactly the rows that were loaded into PostgreSQL.
+package seed
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Product is a catalog entry. Weight is its relative popularity and the
+// order amount is drawn uniformly from [MinAmount, MaxAmount].
+type Product struct {
+	Name      string  `json:"name"`
+	MinAmount int     `json:"min_amount"`
+	MaxAmount int     `json:"max_amount"`
+	Weight    float64 `json:"weight"`
+}
+
+// Config controls the size and shape of a generated dataset.
+type Config struct {
+	Seed   int64
+	Users  int
+	Orders int
+
+	MinAge int
+	MaxAge int
+
+	// OrderSkew is the Zipf exponent for orders per user. Values above 1
+	// concentrate orders on a few heavy users; 0 spreads them uniformly.
+	OrderSkew float64
+
+	Products []Product
+}
+
+// DefaultProducts is a small catalog with a long tail of rare, expensive items.
+var DefaultProducts = []Product{
+	{Name: "Coffee", MinAmount: 3, MaxAmount: 8, Weight: 30},
+	{Name: "Book", MinAmount: 10, MaxAmount: 40, Weight: 20},
+	{Name: "Headphones", MinAmount: 30, MaxAmount: 300, Weight: 10},
+	{Name: "Keyboard", MinAmount: 40, MaxAmount: 200, Weight: 8},
+	{Name: "Monitor", MinAmount: 150, MaxAmount: 900, Weight: 5},
+	{Name: "Laptop", MinAmount: 600, MaxAmount: 3000, Weight: 2},
+}
+
+// DefaultConfig returns a config for 1,000 users and 10,000 orders.
+func DefaultConfig() Config {
+	return Config{
+		Seed:      1,
+		Users:     1000,
+		Orders:    10000,
+		MinAge:    18,
+		MaxAge:    80,
+		OrderSkew: 1.2,
+		Products:  DefaultProducts,
+	}
+}
+
+// User matches a row of the users table. IDs start at 1.
+type User struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Age   int    `json:"age"`
+}
+
+// Order matches a row of the orders table. UserID refers to User.ID.
+type Order struct {
+	ID      int    `json:"id"`
+	UserID  int    `json:"user_id"`
+	Product string `json:"product"`
+	Amount  int    `json:"amount"`
+}
+
+type Dataset struct {
+	Users  []User
+	Orders []Order
+}
+
+var (
+	firstNames = []string{"Alice", "Bob", "Charlie", "Dana", "Eve", "Frank", "Grace", "Heidi", "Ivan", "Judy", "Mallory", "Niaj", "Olivia", "Peggy", "Rupert", "Sybil", "Trent", "Victor", "Walter", "Zoe"}
+	lastNames  = []string{"Smith", "Johnson", "Lee", "Brown", "Garcia", "Miller", "Davis", "Martinez", "Lopez", "Wilson", "Anderson", "Taylor", "Thomas", "Moore", "Jackson"}
+)
+
+// Validate reports configuration errors before any data is generated.
+func (c Config) Validate() error {
+	switch {
+	case c.Users < 0 || c.Orders < 0:
+		return fmt.Errorf("seed: negative users or orders")
+	case c.Orders > 0 && c.Users == 0:
+		return fmt.Errorf("seed: orders need at least one user")
+	case c.MinAge > c.MaxAge:
+		return fmt.Errorf("seed: min age %d above max age %d", c.MinAge, c.MaxAge)
+	case c.OrderSkew != 0 && c.OrderSkew <= 1:
+		return fmt.Errorf("seed: order skew must be 0 or greater than 1, got %g", c.OrderSkew)
+	case c.Orders > 0 && len(c.Products) == 0:
+		return fmt.Errorf("seed: empty product catalog")
+	}
+	for _, p := range c.Products {
+		if p.MinAmount > p.MaxAmount || p.Weight <= 0 {
+			return fmt.Errorf("seed: invalid product %q", p.Name)
+		}
+	}
+	return nil
+}
+
+// Generate builds the dataset described by c.
+func Generate(c Config) (Dataset, error) {
+	if err := c.Validate(); err != nil {
+		return Dataset{}, err
+	}
+	r := rand.New(rand.NewSource(c.Seed))
+
+	users := make([]User, c.Users)
+	for i := range users {
+		first := firstNames[r.Intn(len(firstNames))]
+		last := lastNames[r.Intn(len(lastNames))]
+		users[i] = User{
+			ID:    i + 1,
+			Name:  first + " " + last,
+			Email: fmt.Sprintf("%s.%s.%d@example.com", strings.ToLower(first), strings.ToLower(last), i+1),
+			Age:   c.MinAge + r.Intn(c.MaxAge-c.MinAge+1),
+		}
+	}
+
+	// Zipf ranks are shuffled so heavy buyers are not simply the lowest IDs
+	pickUser := func() int { return r.Intn(c.Users) }
+	if c.OrderSkew > 1 && c.Users > 0 {
+		zipf := rand.NewZipf(r, c.OrderSkew, 1, uint64(c.Users-1))
+		rank := r.Perm(c.Users)
+		pickUser = func() int { return rank[zipf.Uint64()] }
+	}
+
+	var totalWeight float64
+	for _, p := range c.Products {
+		totalWeight += p.Weight
+	}
+	pickProduct := func() Product {
+		w := r.Float64() * totalWeight
+		for _, p := range c.Products {
+			if w < p.Weight {
+				return p
+			}
+			w -= p.Weight
+		}
+		return c.Products[len(c.Products)-1]
+	}
+
+	orders := make([]Order, c.Orders)
+	for i := range orders {
+		p := pickProduct()
+		orders[i] = Order{
+			ID:      i + 1,
+			UserID:  users[pickUser()].ID,
+			Product: p.Name,
+			Amount:  p.MinAmount + r.Intn(p.MaxAmount-p.MinAmount+1),
+		}
+	}
+	return Dataset{Users: users, Orders: orders}, nil
+}
+
+const (
+	UsersFile  = "users.jsonl"
+	OrdersFile = "orders.jsonl"
+)
+
+// WriteJSONLines writes users.jsonl and orders.jsonl into dir.
+func (d Dataset) WriteJSONLines(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeJSONLines(filepath.Join(dir, UsersFile), d.Users); err != nil {
+		return err
+	}
+	return writeJSONLines(filepath.Join(dir, OrdersFile), d.Orders)
+}
+
+func writeJSONLines[T any](path string, values []T) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, v := range values {
+		if err := enc.Encode(v); err != nil {
+			f.Close()
+			return fmt.Errorf("seed: writing %s: %w", path, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
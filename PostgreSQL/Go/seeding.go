@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"example/seed"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Generate a synthetic dataset, load it with COPY and optionally write it
+// as JSON Lines for the MongoDB and Elasticsearch examples.
+//
+//	go run . seed -users 10000 -orders 200000 -seed 42 -out ../../dataset
+func seedCommand(ctx context.Context, args []string) {
+	config := seed.DefaultConfig()
+	flags := flag.NewFlagSet("seed", flag.ExitOnError)
+	flags.Int64Var(&config.Seed, "seed", config.Seed, "random seed; the same seed produces the same dataset")
+	flags.IntVar(&config.Users, "users", config.Users, "number of users")
+	flags.IntVar(&config.Orders, "orders", config.Orders, "number of orders")
+	flags.IntVar(&config.MinAge, "min-age", config.MinAge, "minimum user age")
+	flags.IntVar(&config.MaxAge, "max-age", config.MaxAge, "maximum user age")
+	flags.Float64Var(&config.OrderSkew, "skew", config.OrderSkew, "Zipf exponent for orders per user (>1), or 0 for uniform")
+	out := flags.String("out", "", "directory to write users.jsonl and orders.jsonl to")
+	reset := flags.Bool("reset", false, "truncate users and orders before loading; required when they have rows")
+	flags.Parse(args)
+
+	dataset, err := seed.Generate(config)
+	if err != nil {
+		log.Fatalf("Unable to generate dataset: %v\n", err)
+	}
+
+	if *out != "" {
+		err = dataset.WriteJSONLines(*out)
+		if err != nil {
+			log.Fatalf("Unable to write dataset: %v\n", err)
+		}
+		log.Printf("Dataset written to %s\n", *out)
+	}
+
+	createTables(ctx)
+	err = loadDataset(ctx, dataset, *reset)
+	if err != nil {
+		log.Fatalf("Unable to load dataset: %v\n", err)
+	}
+	log.Printf("Seeded %d users and %d orders\n", len(dataset.Users), len(dataset.Orders))
+}
+
+// Bulk load a dataset with COPY in a single transaction. The rows keep the
+// dataset's IDs and emails so they match what the MongoDB and
+// Elasticsearch examples load, which needs empty tables: without reset,
+// loading into tables that already have rows fails rather than colliding
+// on the primary key or UNIQUE(email). Reset also clears the order events
+// and idempotency keys that refer to the old orders.
+func loadDataset(ctx context.Context, dataset seed.Dataset, reset bool) error {
+	return executeTx(ctx, opBulk, func(tx pgx.Tx) error {
+		if reset {
+			_, err := tx.Exec(ctx, "TRUNCATE order_events, idempotency_keys, orders, users RESTART IDENTITY")
+			if err != nil {
+				return err
+			}
+		} else {
+			var populated bool
+			err := tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM users) OR EXISTS (SELECT 1 FROM orders)").Scan(&populated)
+			if err != nil {
+				return err
+			}
+			if populated {
+				return errors.New("users or orders already has rows; seed with -reset to replace them")
+			}
+		}
+
+		_, err := tx.CopyFrom(ctx, pgx.Identifier{"users"}, []string{"id", "name", "email", "age"},
+			pgx.CopyFromSlice(len(dataset.Users), func(i int) ([]interface{}, error) {
+				u := dataset.Users[i]
+				return []interface{}{u.ID, u.Name, u.Email, u.Age}, nil
+			}))
+		if err != nil {
+			return fmt.Errorf("copy users: %w", err)
+		}
+
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"orders"}, []string{"id", "user_id", "product", "amount"},
+			pgx.CopyFromSlice(len(dataset.Orders), func(i int) ([]interface{}, error) {
+				o := dataset.Orders[i]
+				return []interface{}{o.ID, o.UserID, o.Product, o.Amount}, nil
+			}))
+		if err != nil {
+			return fmt.Errorf("copy orders: %w", err)
+		}
+
+		// COPY with explicit IDs does not advance the SERIAL sequences
+		_, err = tx.Exec(ctx, `
+			SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST((SELECT MAX(id) FROM users), 1)),
+				setval(pg_get_serial_sequence('orders', 'id'), GREATEST((SELECT MAX(id) FROM orders), 1))
+		`)
+		return err
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"example/seed"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testPool points the package's pool at the scratch database in
+// PG_TEST_DSN, skipping the test when it is not set. Tests using it
+// replace the tables' contents.
+func testPool(t *testing.T) {
+	t.Helper()
+	dsn := os.Getenv("PG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PG_TEST_DSN not set")
+	}
+	p, err := pgxpool.Connect(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	saved := pool
+	pool = p
+	t.Cleanup(func() {
+		pool = saved
+		p.Close()
+	})
+}
+
+// Order events refer to orders, so a reset after the lifecycle demo has
+// to clear them too
+func TestLoadDatasetResetAfterLifecycle(t *testing.T) {
+	testPool(t)
+	ctx := context.Background()
+	createTables(ctx)
+
+	config := seed.DefaultConfig()
+	config.Users, config.Orders = 20, 50
+	dataset, err := seed.Generate(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDataset(ctx, dataset, true); err != nil {
+		t.Fatalf("first load: %v", err)
+	}
+	if err := TransitionOrder(ctx, dataset.Orders[0].ID, OrderPending, OrderPaid); err != nil {
+		t.Fatalf("transition: %v", err)
+	}
+
+	if err := loadDataset(ctx, dataset, false); err == nil {
+		t.Error("load into populated tables without reset succeeded")
+	}
+	if err := loadDataset(ctx, dataset, true); err != nil {
+		t.Fatalf("reset after lifecycle: %v", err)
+	}
+	var events int
+	if err := pool.QueryRow(ctx, "SELECT count(*) FROM order_events").Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if events != 0 {
+		t.Errorf("%d order events survived the reset", events)
+	}
+}
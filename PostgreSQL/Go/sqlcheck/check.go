@@ -0,0 +1,205 @@
+// Package sqlcheck flags SQL that is almost certainly a mistake: duplicate
+// SET targets (including ON CONFLICT DO UPDATE), UPDATE or DELETE without
+// WHERE (including inside CTEs), predicates that can never match, and
+// SELECT * over joined tables.
+//
+// It is a heuristic checker, not a parser for the full grammar. Anything it
+// does not understand is skipped rather than reported, so a clean result
+// means "nothing suspicious found", not "correct". Check needs no database,
+// so it can run in unit tests against the statements an operation sends.
+package sqlcheck
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Rule string
+
+const (
+	DuplicateSet   Rule = "duplicate-set"
+	MissingWhere   Rule = "missing-where"
+	Contradiction  Rule = "contradiction"
+	SelectStarJoin Rule = "select-star-join"
+)
+
+type Finding struct {
+	Rule    Rule
+	Message string
+	// Byte offset of the offending clause in the checked SQL
+	Offset int
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s at offset %d: %s", f.Rule, f.Offset, f.Message)
+}
+
+// Check every statement in sql, which may hold several separated by ";"
+func Check(sql string) []Finding {
+	var findings []Finding
+	for _, stmt := range splitTop(lex(sql), ";") {
+		findings = append(findings, checkStatement(sql, stmt)...)
+	}
+	return findings
+}
+
+func checkStatement(sql string, tokens []token) []Finding {
+	if len(tokens) == 0 {
+		return nil
+	}
+	// Look past EXPLAIN options and CTEs to the statement proper
+	main := findTop(tokens, 0, "select", "update", "delete", "insert", "values")
+	if main < 0 {
+		return nil
+	}
+	var findings []Finding
+	// Data-modifying CTEs are statements of their own
+	if with := findTop(tokens[:main], 0, "with"); with >= 0 {
+		for _, body := range cteBodies(tokens[with+1 : main]) {
+			findings = append(findings, checkStatement(sql, body)...)
+		}
+	}
+	tokens = tokens[main:]
+
+	switch tokens[0].text {
+	case "insert":
+		// ON CONFLICT ... DO UPDATE SET
+		findings = append(findings, checkSet(tokens)...)
+	case "update":
+		findings = append(findings, checkSet(tokens)...)
+		if findTop(tokens, 0, "where") < 0 {
+			findings = append(findings, Finding{MissingWhere, "UPDATE without WHERE changes every row", tokens[0].start})
+		}
+	case "delete":
+		if findTop(tokens, 0, "where") < 0 {
+			findings = append(findings, Finding{MissingWhere, "DELETE without WHERE removes every row", tokens[0].start})
+		}
+	case "select":
+		findings = append(findings, checkSelectStar(tokens)...)
+	}
+	if where := whereClause(tokens); where != nil {
+		findings = append(findings, checkPredicates(sql, where)...)
+	}
+	return findings
+}
+
+// The parenthesized bodies of the CTEs in a WITH list:
+// name [(columns)] AS [[NOT] MATERIALIZED] (body), ...
+func cteBodies(tokens []token) [][]token {
+	var bodies [][]token
+	for i := 0; i < len(tokens); i++ {
+		if !tokens[i].is(tokKeyword, "as") {
+			continue
+		}
+		j := i + 1
+		for j < len(tokens) && (tokens[j].is(tokKeyword, "not") || tokens[j].is(tokIdent, "materialized")) {
+			j++
+		}
+		if j < len(tokens) && tokens[j].is(tokOp, "(") {
+			end := closing(tokens, j)
+			bodies = append(bodies, tokens[j+1:end])
+			i = end
+		}
+	}
+	return bodies
+}
+
+// Flag columns assigned more than once; PostgreSQL rejects these at run time
+func checkSet(tokens []token) []Finding {
+	set := findTop(tokens, 0, "set")
+	if set < 0 {
+		return nil
+	}
+	end := findTop(tokens, set+1, "from", "where", "returning")
+	if end < 0 {
+		end = len(tokens)
+	}
+
+	var findings []Finding
+	seen := map[string]bool{}
+	for _, assignment := range splitTop(tokens[set+1:end], ",") {
+		for _, target := range setTargets(assignment) {
+			if seen[target.text] {
+				findings = append(findings, Finding{DuplicateSet, fmt.Sprintf("column %q is assigned more than once in SET", target.text), target.start})
+			}
+			seen[target.text] = true
+		}
+	}
+	return findings
+}
+
+// The columns on the left of one assignment: col = ..., col[1] = ...,
+// col.field = ... or (a, b) = ...
+func setTargets(assignment []token) []token {
+	if len(assignment) == 0 {
+		return nil
+	}
+	if assignment[0].is(tokOp, "(") {
+		var targets []token
+		for _, t := range assignment[1:closing(assignment, 0)] {
+			if t.kind == tokIdent {
+				targets = append(targets, t)
+			}
+		}
+		return targets
+	}
+	if assignment[0].kind == tokIdent {
+		return assignment[:1]
+	}
+	return nil
+}
+
+// SELECT * over a join returns every column of every table, including
+// duplicated names that silently shadow each other when scanned
+func checkSelectStar(tokens []token) []Finding {
+	from := findTop(tokens, 1, "from")
+	if from < 0 {
+		return nil
+	}
+	var star *token
+	for _, item := range splitTop(tokens[1:from], ",") {
+		for len(item) > 0 && (item[0].is(tokKeyword, "distinct") || item[0].is(tokKeyword, "all")) {
+			item = item[1:]
+		}
+		if len(item) == 1 && item[0].is(tokOp, "*") {
+			star = &item[0]
+		}
+	}
+	if star == nil {
+		return nil
+	}
+
+	end := findTop(tokens, from+1, "where", "group", "having", "order", "limit", "offset", "window", "for", "union", "intersect", "except", "fetch")
+	if end < 0 {
+		end = len(tokens)
+	}
+	fromItems := tokens[from+1 : end]
+	if findTop(fromItems, 0, "join") >= 0 || len(splitTop(fromItems, ",")) > 1 {
+		return []Finding{{SelectStarJoin, "SELECT * over joined tables; list the columns you need", star.start}}
+	}
+	return nil
+}
+
+// The tokens of the top-level WHERE clause, or nil
+func whereClause(tokens []token) []token {
+	where := findTop(tokens, 0, "where")
+	if where < 0 {
+		return nil
+	}
+	end := findTop(tokens, where+1, "group", "having", "order", "limit", "offset", "window", "for", "returning", "union", "intersect", "except", "fetch")
+	if end < 0 {
+		end = len(tokens)
+	}
+	clause := tokens[where+1 : end]
+	if len(clause) > 0 && clause[0].is(tokKeyword, "current") {
+		return nil
+	}
+	return clause
+}
+
+func snippet(sql string, tokens []token) string {
+	if len(tokens) == 0 {
+		return ""
+	}
+	return strings.Join(strings.Fields(sql[tokens[0].start:tokens[len(tokens)-1].end]), " ")
+}
@@ -0,0 +1,144 @@
+package sqlcheck
+
+import (
+	"reflect"
+	"testing"
+)
+
+func rules(findings []Finding) []Rule {
+	var rs []Rule
+	for _, f := range findings {
+		rs = append(rs, f.Rule)
+	}
+	return rs
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []Rule
+	}{
+		// The statements the request called out
+		{
+			name: "queryOperators",
+			sql: `SELECT id, name, email, age FROM users
+				WHERE age >= 18 AND age <= 30
+					AND name IN ('Alice', 'Bob')
+					AND (age < 25 OR name = 'Charlie')
+					AND age > 20 AND name <> 'Dave'`,
+			want: []Rule{Contradiction},
+		},
+		{
+			name: "updateOperators",
+			sql: `UPDATE users AS t SET
+					age = age + 1,
+					name = 'Updated Name',
+					age = CASE WHEN age > 30 THEN age - 1 ELSE age END,
+					email = NULL
+				WHERE name = $1 RETURNING to_jsonb(t.*)`,
+			want: []Rule{DuplicateSet},
+		},
+
+		// The library's own statements
+		{name: "create_user", sql: "INSERT INTO users (name, email, age) VALUES ($1, $2, $3) RETURNING id"},
+		{name: "get_users", sql: "SELECT id, name, email, age FROM users"},
+		{name: "update_user", sql: "UPDATE users SET name = $1, email = $2, age = $3 WHERE id = $4 RETURNING id"},
+		{name: "delete_user", sql: "DELETE FROM users WHERE id = $1 RETURNING id"},
+		{name: "renew lock", sql: `SELECT EXISTS (
+			SELECT 1 FROM pg_locks
+			WHERE locktype = 'advisory'
+				AND pid = pg_backend_pid()
+				AND granted
+				AND classid = (($1::bigint >> 32) & 4294967295)::bigint::oid
+				AND objid = ($1::bigint & 4294967295)::bigint::oid
+				AND objsubid = 1
+		)`},
+		{name: "set attribute", sql: `UPDATE users SET attributes = (SELECT jsonb_set(a1, $2, $3)
+			FROM (SELECT attributes AS a0) s0,
+				LATERAL (SELECT jsonb_set(a0, $4, COALESCE(a0 #> $4, '{}')) AS a1) s1)
+			WHERE id = $1`},
+
+		// SET targets
+		{name: "row assignment", sql: "UPDATE t SET (a, b) = (1, 2), a = 3 WHERE id = 1", want: []Rule{DuplicateSet}},
+		{name: "distinct targets", sql: "UPDATE t SET a = 1, b = a WHERE id = 1"},
+		{
+			name: "on conflict duplicate",
+			sql:  "INSERT INTO t (id, a) VALUES (1, 2) ON CONFLICT (id) DO UPDATE SET a = excluded.a, a = t.a + 1",
+			want: []Rule{DuplicateSet},
+		},
+		{name: "on conflict", sql: "INSERT INTO t (id, a) VALUES (1, 2) ON CONFLICT (id) DO UPDATE SET a = excluded.a WHERE t.a < 10"},
+		{name: "on conflict do nothing", sql: "INSERT INTO t (id) VALUES (1) ON CONFLICT DO NOTHING"},
+
+		// Missing WHERE
+		{name: "update without where", sql: "UPDATE t SET a = 1", want: []Rule{MissingWhere}},
+		{name: "delete without where", sql: "DELETE FROM t", want: []Rule{MissingWhere}},
+		{name: "where in subquery only", sql: "DELETE FROM t USING (SELECT id FROM u WHERE x = 1) s", want: []Rule{MissingWhere}},
+		{name: "where current of", sql: "DELETE FROM t WHERE CURRENT OF c"},
+		{
+			name: "delete in cte",
+			sql:  "WITH gone AS (DELETE FROM t RETURNING *) SELECT count(*) FROM gone",
+			want: []Rule{MissingWhere},
+		},
+		{
+			name: "update in materialized cte",
+			sql:  "WITH moved AS MATERIALIZED (UPDATE t SET a = 1, a = 2 RETURNING id) INSERT INTO log SELECT id FROM moved",
+			want: []Rule{DuplicateSet, MissingWhere},
+		},
+		{name: "qualified cte", sql: "WITH gone AS (DELETE FROM t WHERE id = $1 RETURNING *) SELECT * FROM gone"},
+		{name: "explain", sql: "EXPLAIN (ANALYZE, BUFFERS) UPDATE t SET a = 1", want: []Rule{MissingWhere}},
+
+		// Contradictions
+		{name: "equal to two values", sql: "SELECT a FROM t WHERE a = 1 AND a = 2", want: []Rule{Contradiction}},
+		{name: "empty range", sql: "SELECT a FROM t WHERE a > 5 AND a < 3", want: []Rule{Contradiction}},
+		{name: "open range", sql: "SELECT a FROM t WHERE a > 5 AND a <= 5", want: []Rule{Contradiction}},
+		{name: "point range", sql: "SELECT a FROM t WHERE a >= 5 AND a <= 5"},
+		{name: "between", sql: "SELECT a FROM t WHERE a BETWEEN 10 AND 20 AND a < 10", want: []Rule{Contradiction}},
+		{name: "negative", sql: "SELECT a FROM t WHERE a < -1 AND a > -5"},
+		{name: "in and not in", sql: "SELECT a FROM t WHERE a IN (1, 2) AND a NOT IN (1, 2)", want: []Rule{Contradiction}},
+		{name: "dead or branch", sql: "SELECT a FROM t WHERE a = 1 AND (b = 2 OR a = 3)", want: []Rule{Contradiction}},
+		{name: "no live or branch", sql: "SELECT a FROM t WHERE a = 1 AND (a = 2 OR a = 3)", want: []Rule{Contradiction}},
+		{name: "null and compared", sql: "SELECT a FROM t WHERE a IS NULL AND a = 1", want: []Rule{Contradiction}},
+		{name: "equals null", sql: "SELECT a FROM t WHERE a = NULL", want: []Rule{Contradiction}},
+		{name: "string equality", sql: "SELECT a FROM t WHERE name = 'a' AND name = 'b'", want: []Rule{Contradiction}},
+		// String order depends on the collation, so string ranges are not judged
+		{name: "string range", sql: "SELECT a FROM t WHERE name > 'b' AND name < 'B'"},
+		{name: "string in range", sql: "SELECT a FROM t WHERE name IN ('a') AND name > 'b'"},
+		// Values of different kinds are not compared
+		{name: "mixed kind not equal", sql: "SELECT a FROM t WHERE a = 5 AND a <> 'x'"},
+		{name: "mixed kind not in", sql: "SELECT a FROM t WHERE a = 5 AND a NOT IN ('x', 'y')"},
+		{name: "mixed kind in", sql: "SELECT a FROM t WHERE a = 5 AND a IN ('x', 6)"},
+		{name: "mixed kind not in match", sql: "SELECT a FROM t WHERE a = 5 AND a NOT IN ('x', 5)", want: []Rule{Contradiction}},
+		{name: "parameters", sql: "SELECT a FROM t WHERE a = $1 AND a = $2"},
+		{name: "different columns", sql: "SELECT a FROM t WHERE a = 1 AND b = 2"},
+		{name: "subquery", sql: "SELECT a FROM t WHERE a IN (SELECT a FROM u WHERE a = 1 AND a = 2)"},
+
+		// SELECT *
+		{name: "star join", sql: "SELECT * FROM t JOIN u ON u.id = t.id", want: []Rule{SelectStarJoin}},
+		{name: "star comma join", sql: "SELECT DISTINCT * FROM t, u WHERE u.id = t.id", want: []Rule{SelectStarJoin}},
+		{name: "star one table", sql: "SELECT * FROM t WHERE id = 1"},
+		{name: "qualified star", sql: "SELECT t.* FROM t JOIN u ON u.id = t.id"},
+
+		// Several statements
+		{name: "script", sql: "UPDATE t SET a = 1; DELETE FROM u WHERE id = 1; DELETE FROM v", want: []Rule{MissingWhere, MissingWhere}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := Check(tt.sql)
+			if got := rules(findings); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check() rules = %v, want %v\nfindings: %v", got, tt.want, findings)
+			}
+		})
+	}
+}
+
+func TestFindingOffset(t *testing.T) {
+	sql := "UPDATE t SET a = 1, b = 2, a = 3 WHERE id = 1"
+	findings := Check(sql)
+	if len(findings) != 1 {
+		t.Fatalf("findings = %v, want one", findings)
+	}
+	if got := sql[findings[0].Offset:]; got[:5] != "a = 3" {
+		t.Errorf("finding at %q, want the second assignment to a", got)
+	}
+}
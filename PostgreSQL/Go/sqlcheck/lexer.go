@@ -0,0 +1,180 @@
+package sqlcheck
+
+import "strings"
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokKeyword
+	tokNumber
+	tokString
+	tokParam
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	// Keywords and unquoted identifiers are lower-cased
+	text       string
+	start, end int
+}
+
+func (t token) is(kind tokenKind, text string) bool {
+	return t.kind == kind && t.text == text
+}
+
+// Words that end an identifier or expression; anything else is an identifier
+var keywords = map[string]bool{
+	"select": true, "insert": true, "update": true, "delete": true, "with": true,
+	"from": true, "where": true, "set": true, "join": true, "on": true, "using": true,
+	"and": true, "or": true, "not": true, "in": true, "is": true, "null": true,
+	"between": true, "like": true, "ilike": true, "as": true, "only": true,
+	"group": true, "order": true, "having": true, "limit": true, "offset": true,
+	"returning": true, "for": true, "union": true, "intersect": true, "except": true,
+	"window": true, "fetch": true, "distinct": true, "all": true, "values": true,
+	"inner": true, "left": true, "right": true, "full": true, "cross": true,
+	"natural": true, "lateral": true, "into": true, "current": true, "of": true,
+	"explain": true, "case": true, "when": true, "then": true, "else": true, "end": true,
+	"exists": true, "any": true, "some": true, "true": true, "false": true,
+}
+
+// Split SQL into tokens, dropping whitespace and comments. The lexer is
+// forgiving: anything it does not recognise becomes a one-character operator.
+func lex(sql string) []token {
+	var tokens []token
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+		case c == '\'':
+			var b strings.Builder
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						b.WriteByte('\'')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(sql[i])
+			}
+			i++
+			tokens = append(tokens, token{kind: tokString, text: b.String(), start: start, end: min(i, len(sql))})
+		case c == '"':
+			end := strings.IndexByte(sql[i+1:], '"')
+			if end < 0 {
+				end = len(sql) - i - 1
+			}
+			i += end + 2
+			tokens = append(tokens, token{kind: tokIdent, text: sql[start+1 : start+1+end], start: start, end: min(i, len(sql))})
+		case c == '$' && i+1 < len(sql) && isDigit(sql[i+1]):
+			for i++; i < len(sql) && isDigit(sql[i]); i++ {
+			}
+			tokens = append(tokens, token{kind: tokParam, text: sql[start:i], start: start, end: i})
+		case isDigit(c) || c == '.' && i+1 < len(sql) && isDigit(sql[i+1]):
+			for i < len(sql) && (isDigit(sql[i]) || sql[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: sql[start:i], start: start, end: i})
+		case isIdentStart(c):
+			for i < len(sql) && (isIdentStart(sql[i]) || isDigit(sql[i]) || sql[i] == '$') {
+				i++
+			}
+			word := strings.ToLower(sql[start:i])
+			kind := tokIdent
+			if keywords[word] {
+				kind = tokKeyword
+			}
+			tokens = append(tokens, token{kind: kind, text: word, start: start, end: i})
+		default:
+			i++
+			for _, op := range []string{"<>", "!=", "<=", ">=", "::"} {
+				if strings.HasPrefix(sql[start:], op) {
+					i = start + len(op)
+					break
+				}
+			}
+			tokens = append(tokens, token{kind: tokOp, text: sql[start:i], start: start, end: i})
+		}
+	}
+	return tokens
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// Index of the parenthesis closing the one at open, or len(tokens)
+func closing(tokens []token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch {
+		case tokens[i].is(tokOp, "("):
+			depth++
+		case tokens[i].is(tokOp, ")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// Split tokens on a top-level operator such as "," or ";"
+func splitTop(tokens []token, sep string) [][]token {
+	var parts [][]token
+	depth, start := 0, 0
+	for i, t := range tokens {
+		switch {
+		case t.is(tokOp, "(") || t.is(tokKeyword, "case"):
+			depth++
+		case t.is(tokOp, ")") || t.is(tokKeyword, "end"):
+			depth--
+		case depth == 0 && t.is(tokOp, sep):
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+// Index of the first top-level keyword from words at or after from, or -1
+func findTop(tokens []token, from int, words ...string) int {
+	depth := 0
+	for i := from; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.is(tokOp, "(") || t.is(tokKeyword, "case"):
+			depth++
+		case t.is(tokOp, ")") || t.is(tokKeyword, "end"):
+			depth--
+		case depth == 0 && t.kind == tokKeyword:
+			for _, w := range words {
+				if t.text == w {
+					return i
+				}
+			}
+		}
+	}
+	return -1
+}
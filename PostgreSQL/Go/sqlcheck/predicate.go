@@ -0,0 +1,459 @@
+package sqlcheck
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A WHERE clause as a tree of AND and OR nodes over atoms. Only atoms
+// comparing a column with literals carry constraints; everything else, such
+// as parameters, function calls and subqueries, is opaque and admits any row.
+type node struct {
+	op       string // "and", "or" or "" for an atom
+	children []*node
+	tokens   []token
+
+	constraints []constraint
+	nullCompare bool
+}
+
+type constraint struct {
+	column string
+	op     string // in, notin, <, <=, >, >=, null, notnull
+	values []value
+}
+
+type value struct {
+	num   float64
+	str   string
+	isNum bool
+}
+
+func parsePredicate(tokens []token) *node {
+	if parts := splitBool(tokens, "or"); len(parts) > 1 {
+		return branch("or", tokens, parts)
+	}
+	if parts := splitBool(tokens, "and"); len(parts) > 1 {
+		return branch("and", tokens, parts)
+	}
+	if len(tokens) > 2 && tokens[0].is(tokOp, "(") && closing(tokens, 0) == len(tokens)-1 && !tokens[1].is(tokKeyword, "select") {
+		n := parsePredicate(tokens[1 : len(tokens)-1])
+		n.tokens = tokens
+		return n
+	}
+	return parseAtom(tokens)
+}
+
+func branch(op string, tokens []token, parts [][]token) *node {
+	n := &node{op: op, tokens: tokens}
+	for _, part := range parts {
+		child := parsePredicate(part)
+		// Flatten a AND (b AND c) so the conjuncts are checked together
+		if child.op == op {
+			n.children = append(n.children, child.children...)
+		} else {
+			n.children = append(n.children, child)
+		}
+	}
+	return n
+}
+
+// Split on a top-level AND or OR, skipping the AND of BETWEEN x AND y
+func splitBool(tokens []token, word string) [][]token {
+	var parts [][]token
+	depth, start, between := 0, 0, false
+	for i, t := range tokens {
+		switch {
+		case t.is(tokOp, "(") || t.is(tokKeyword, "case"):
+			depth++
+		case t.is(tokOp, ")") || t.is(tokKeyword, "end"):
+			depth--
+		case depth == 0 && t.is(tokKeyword, "between"):
+			between = true
+		case depth == 0 && t.is(tokKeyword, "and") && between:
+			between = false
+		case depth == 0 && t.is(tokKeyword, word):
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+var flipped = map[string]string{"=": "=", "<>": "<>", "!=": "!=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+func parseAtom(tokens []token) *node {
+	n := &node{tokens: tokens}
+	column, i, ok := parseColumn(tokens, 0)
+	if !ok {
+		// literal op column
+		v, j, ok := parseLiteral(tokens, 0)
+		if !ok || j >= len(tokens) || flipped[tokens[j].text] == "" || tokens[j].kind != tokOp {
+			return n
+		}
+		column, k, ok := parseColumn(tokens, j+1)
+		if ok && k == len(tokens) {
+			n.compare(column, flipped[tokens[j].text], v)
+		}
+		return n
+	}
+	if i >= len(tokens) {
+		return n
+	}
+
+	not := tokens[i].is(tokKeyword, "not")
+	if not {
+		i++
+	}
+	switch t := tokens[i]; {
+	case t.kind == tokOp && flipped[t.text] != "" && !not:
+		v, j, ok := parseLiteral(tokens, i+1)
+		if ok && j == len(tokens) {
+			n.compare(column, t.text, v)
+		}
+	case t.is(tokKeyword, "in") && i+1 < len(tokens) && tokens[i+1].is(tokOp, "("):
+		end := closing(tokens, i+1)
+		if end != len(tokens)-1 {
+			return n
+		}
+		var values []value
+		for _, item := range splitTop(tokens[i+2:end], ",") {
+			v, j, ok := parseLiteral(item, 0)
+			if !ok || j != len(item) || v == nil {
+				return n
+			}
+			values = append(values, *v)
+		}
+		op := "in"
+		if not {
+			op = "notin"
+		}
+		n.constraints = []constraint{{column, op, values}}
+	case t.is(tokKeyword, "between") && !not:
+		lo, j, ok := parseLiteral(tokens, i+1)
+		if !ok || lo == nil || j >= len(tokens) || !tokens[j].is(tokKeyword, "and") {
+			return n
+		}
+		hi, k, ok := parseLiteral(tokens, j+1)
+		if ok && hi != nil && k == len(tokens) {
+			n.constraints = []constraint{{column, ">=", []value{*lo}}, {column, "<=", []value{*hi}}}
+		}
+	case t.is(tokKeyword, "is") && !not:
+		rest := tokens[i+1:]
+		switch {
+		case len(rest) == 1 && rest[0].is(tokKeyword, "null"):
+			n.constraints = []constraint{{column, "null", nil}}
+		case len(rest) == 2 && rest[0].is(tokKeyword, "not") && rest[1].is(tokKeyword, "null"):
+			n.constraints = []constraint{{column, "notnull", nil}}
+		}
+	}
+	return n
+}
+
+// Record column op v; a nil v is the NULL literal
+func (n *node) compare(column, op string, v *value) {
+	if v == nil {
+		n.nullCompare = true
+		return
+	}
+	switch op {
+	case "=":
+		n.constraints = []constraint{{column, "in", []value{*v}}}
+	case "<>", "!=":
+		n.constraints = []constraint{{column, "notin", []value{*v}}}
+	default:
+		n.constraints = []constraint{{column, op, []value{*v}}}
+	}
+}
+
+// A possibly qualified column name: a, t.a or "T"."a"
+func parseColumn(tokens []token, i int) (string, int, bool) {
+	if i >= len(tokens) || tokens[i].kind != tokIdent {
+		return "", i, false
+	}
+	name := tokens[i].text
+	i++
+	for i+1 < len(tokens) && tokens[i].is(tokOp, ".") && tokens[i+1].kind == tokIdent {
+		name += "." + tokens[i+1].text
+		i += 2
+	}
+	if i < len(tokens) && tokens[i].is(tokOp, "(") {
+		// A function call, not a column
+		return "", i, false
+	}
+	return name, i, true
+}
+
+// A string or number literal with an optional sign and cast, or NULL, which
+// is returned as a nil value
+func parseLiteral(tokens []token, i int) (*value, int, bool) {
+	if i >= len(tokens) {
+		return nil, i, false
+	}
+	var v *value
+	sign := 1.0
+	if tokens[i].is(tokOp, "-") && i+1 < len(tokens) && tokens[i+1].kind == tokNumber {
+		sign = -1
+		i++
+	}
+	switch t := tokens[i]; {
+	case t.kind == tokString:
+		v = &value{str: t.text}
+	case t.kind == tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, i, false
+		}
+		v = &value{num: sign * f, isNum: true}
+	case t.is(tokKeyword, "null"):
+	default:
+		return nil, i, false
+	}
+	i++
+	for i+1 < len(tokens) && tokens[i].is(tokOp, "::") && tokens[i+1].kind == tokIdent {
+		i += 2
+	}
+	return v, i, true
+}
+
+// Order two numbers. ok is false for strings, whose order depends on the
+// column's collation, and across kinds.
+func compareValues(a, b value) (int, bool) {
+	if !a.isNum || !b.isNum {
+		return 0, false
+	}
+	switch {
+	case a.num < b.num:
+		return -1, true
+	case a.num > b.num:
+		return 1, true
+	}
+	return 0, true
+}
+
+// Whether two values are equal; ok is false across kinds
+func equalValues(a, b value) (equal, ok bool) {
+	if a.isNum != b.isNum {
+		return false, false
+	}
+	if a.isNum {
+		return a.num == b.num, true
+	}
+	return a.str == b.str, true
+}
+
+// Whether a row with the column set to v could satisfy c. Comparisons
+// across kinds and string ranges are not understood, so they admit v.
+func (c constraint) admits(v value) bool {
+	switch c.op {
+	case "null":
+		return false
+	case "notnull":
+		return true
+	case "in", "notin":
+		// A value of another kind might equal v after a cast: count it as
+		// found for IN and as not found for NOT IN, so v is admitted
+		found := false
+		for _, w := range c.values {
+			if equal, ok := equalValues(v, w); equal || !ok && c.op == "in" {
+				found = true
+			}
+		}
+		return found == (c.op == "in")
+	}
+	cmp, ok := compareValues(v, c.values[0])
+	if !ok {
+		return true
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// Whether some row could satisfy all constraints together
+func satisfiable(constraints []constraint) bool {
+	byColumn := map[string][]constraint{}
+	for _, c := range constraints {
+		byColumn[c.column] = append(byColumn[c.column], c)
+	}
+	for _, cs := range byColumn {
+		if !columnSatisfiable(cs) {
+			return false
+		}
+	}
+	return true
+}
+
+func columnSatisfiable(cs []constraint) bool {
+	var isNull, compared bool
+	var candidates []value
+	inSet := false
+	for _, c := range cs {
+		switch c.op {
+		case "null":
+			isNull = true
+		case "notnull":
+			compared = true
+		case "in":
+			compared = true
+			if !inSet {
+				candidates, inSet = c.values, true
+			}
+		default:
+			compared = true
+		}
+	}
+	// Any comparison with a NULL column is not true
+	if isNull {
+		return !compared
+	}
+	if inSet {
+		for _, v := range candidates {
+			admitted := true
+			for _, c := range cs {
+				admitted = admitted && c.admits(v)
+			}
+			if admitted {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only ranges and exclusions: check the tightest bounds
+	var lo, hi *constraint
+	for i := range cs {
+		c := &cs[i]
+		switch c.op {
+		case ">", ">=":
+			if lo == nil || tighter(c, lo, 1) {
+				lo = c
+			}
+		case "<", "<=":
+			if hi == nil || tighter(c, hi, -1) {
+				hi = c
+			}
+		}
+	}
+	if lo == nil || hi == nil {
+		return true
+	}
+	cmp, ok := compareValues(lo.values[0], hi.values[0])
+	switch {
+	case !ok || cmp < 0:
+		return true
+	case cmp > 0:
+		return false
+	case lo.op == ">" || hi.op == "<":
+		return false
+	}
+	// lo = hi: the single remaining value must not be excluded
+	for _, c := range cs {
+		if !c.admits(lo.values[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether bound a is tighter than b in direction dir (1 for lower bounds)
+func tighter(a, b *constraint, dir int) bool {
+	cmp, ok := compareValues(a.values[0], b.values[0])
+	if !ok {
+		return false
+	}
+	return cmp*dir > 0 || cmp == 0 && (a.op == ">" || a.op == "<")
+}
+
+func checkPredicates(sql string, tokens []token) []Finding {
+	c := &predicateChecker{sql: sql}
+	c.analyze(parsePredicate(tokens), nil)
+	return c.findings
+}
+
+type predicateChecker struct {
+	sql      string
+	findings []Finding
+}
+
+func (c *predicateChecker) report(n *node, format string, args ...interface{}) {
+	c.findings = append(c.findings, Finding{Contradiction, fmt.Sprintf(format, args...), n.tokens[0].start})
+}
+
+// Check n given the constraints that must already hold around it
+func (c *predicateChecker) analyze(n *node, outer []constraint) {
+	switch n.op {
+	case "":
+		c.checkNull(n)
+		if !satisfiable(append(outer[:len(outer):len(outer)], n.constraints...)) {
+			c.report(n, "%q can never match", snippet(c.sql, n.tokens))
+		}
+	case "and":
+		conj := append(outer[:len(outer):len(outer)], conjuncts(n)...)
+		for _, child := range n.children {
+			if child.op == "" {
+				c.checkNull(child)
+			}
+		}
+		if !satisfiable(conj) {
+			c.report(n, "predicates can never all hold: %q", snippet(c.sql, n.tokens))
+			return
+		}
+		for _, child := range n.children {
+			if child.op == "or" {
+				c.analyzeOr(child, conj)
+			}
+		}
+	case "or":
+		c.analyzeOr(n, outer)
+	}
+}
+
+// Report OR branches that cannot match alongside outer, and the whole OR if
+// none can
+func (c *predicateChecker) analyzeOr(n *node, outer []constraint) {
+	var dead []*node
+	for _, b := range n.children {
+		if satisfiable(append(outer[:len(outer):len(outer)], conjuncts(b)...)) {
+			c.analyze(b, outer)
+		} else {
+			dead = append(dead, b)
+		}
+	}
+	if len(dead) == len(n.children) {
+		c.report(n, "no branch of %q can match", snippet(c.sql, n.tokens))
+		return
+	}
+	for _, b := range dead {
+		c.report(b, "OR branch %q can never match alongside the rest of the condition", snippet(c.sql, b.tokens))
+	}
+}
+
+func (c *predicateChecker) checkNull(n *node) {
+	if n.nullCompare {
+		c.report(n, "%q compares with NULL and is never true; use IS NULL", snippet(c.sql, n.tokens))
+	}
+}
+
+// The constraints of an atom, or of the atoms directly under an AND
+func conjuncts(n *node) []constraint {
+	switch n.op {
+	case "":
+		return n.constraints
+	case "and":
+		var cs []constraint
+		for _, child := range n.children {
+			if child.op == "" {
+				cs = append(cs, child.constraints...)
+			}
+		}
+		return cs
+	}
+	return nil
+}
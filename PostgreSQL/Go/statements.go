@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// A statement declared once and prepared on every pooled connection. Pass
+// Name as the query to executeQuery or executeExec; pgx sends the prepared
+// statement instead of re-parsing the SQL.
+type Statement struct {
+	Name string
+	SQL  string
+	// Expected parameter types by PostgreSQL type name, e.g. int4 or varchar
+	ParamTypes []string
+}
+
+type statementRegistry struct {
+	statements []*Statement
+	byName     map[string]*Statement
+	// Set once the statements have been validated against the schema;
+	// before that, connections are not prepared
+	ready atomic.Bool
+}
+
+var statements = &statementRegistry{byName: map[string]*Statement{}}
+
+func (r *statementRegistry) register(name, sql string, paramTypes ...string) *Statement {
+	if _, ok := r.byName[name]; ok {
+		panic("statement registered twice: " + name)
+	}
+	s := &Statement{Name: name, SQL: sql, ParamTypes: paramTypes}
+	r.statements = append(r.statements, s)
+	r.byName[name] = s
+	return s
+}
+
+// The SQL to report for a query pgx ran: a statement's SQL for its name,
+// otherwise the query itself
+func (r *statementRegistry) sqlFor(query string) string {
+	if s, ok := r.byName[query]; ok {
+		return s.SQL
+	}
+	return query
+}
+
+var (
+	stmtCreateUser = statements.register("create_user",
+		"INSERT INTO users (name, email, age) VALUES ($1, $2, $3) RETURNING id",
+		"varchar", "varchar", "int4")
+	stmtGetUsers = statements.register("get_users",
+		"SELECT id, name, email, age FROM users")
+	stmtUpdateUser = statements.register("update_user",
+		"UPDATE users SET name = $1, email = $2, age = $3 WHERE id = $4 RETURNING id",
+		"varchar", "varchar", "int4", "int4")
+	stmtDeleteUser = statements.register("delete_user",
+		"DELETE FROM users WHERE id = $1 RETURNING id",
+		"int4")
+)
+
+// One statement that could not be prepared or whose parameters no longer
+// have the declared types
+type StatementFailure struct {
+	Name string
+	Err  error
+}
+
+type StatementErrors []StatementFailure
+
+func (e StatementErrors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("%d prepared statements do not match the schema:", len(e)))
+	for _, f := range e {
+		lines = append(lines, fmt.Sprintf("  %s: %v", f.Name, f.Err))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Prepare every statement on conn, collecting all failures rather than
+// stopping at the first
+func (r *statementRegistry) prepare(ctx context.Context, conn *pgx.Conn) error {
+	var failures StatementErrors
+	for _, s := range r.statements {
+		desc, err := conn.Prepare(ctx, s.Name, s.SQL)
+		if err == nil {
+			err = r.checkParams(conn, s, desc.ParamOIDs)
+		}
+		if err != nil {
+			failures = append(failures, StatementFailure{s.Name, err})
+		}
+	}
+	if len(failures) > 0 {
+		return failures
+	}
+	return nil
+}
+
+func (r *statementRegistry) checkParams(conn *pgx.Conn, s *Statement, oids []uint32) error {
+	if len(oids) != len(s.ParamTypes) {
+		return fmt.Errorf("has %d parameters, declared %d", len(oids), len(s.ParamTypes))
+	}
+	info := conn.ConnInfo()
+	for i, oid := range oids {
+		declared, ok := info.DataTypeForName(s.ParamTypes[i])
+		if !ok {
+			return fmt.Errorf("parameter $%d: unknown type %q", i+1, s.ParamTypes[i])
+		}
+		if declared.OID != oid {
+			actual := fmt.Sprintf("oid %d", oid)
+			if dt, ok := info.DataTypeForOID(oid); ok {
+				actual = dt.Name
+			}
+			return fmt.Errorf("parameter $%d is %s, declared %s", i+1, actual, s.ParamTypes[i])
+		}
+	}
+	return nil
+}
+
+// AfterConnect hook preparing the statements on each new connection once
+// they have been validated. A connection they cannot be prepared on fails
+// to connect.
+func (r *statementRegistry) install(config *pgxpool.Config) {
+	afterConnect := config.AfterConnect
+	config.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+		if afterConnect != nil {
+			if err := afterConnect(ctx, conn); err != nil {
+				return err
+			}
+		}
+		if !r.ready.Load() {
+			return nil
+		}
+		return r.prepare(ctx, conn)
+	}
+}
+
+// Validate the statements against the current schema and prepare them on
+// the connections already in the pool. Call it once the schema is in place
+// and before anything runs the statements; the error lists every statement
+// that failed.
+func (r *statementRegistry) validate(ctx context.Context, pool *pgxpool.Pool) error {
+	// Set first, so a connection dialed while the idle ones are prepared
+	// prepares in AfterConnect rather than being missed by both
+	r.ready.Store(true)
+	conns := pool.AcquireAllIdle(ctx)
+	defer func() {
+		for _, c := range conns {
+			c.Release()
+		}
+	}()
+	if len(conns) == 0 {
+		c, err := pool.Acquire(ctx)
+		if err != nil {
+			r.ready.Store(false)
+			return err
+		}
+		conns = append(conns, c)
+	}
+
+	for _, c := range conns {
+		if err := r.prepare(ctx, c.Conn()); err != nil {
+			r.ready.Store(false)
+			return err
+		}
+	}
+	return nil
+}
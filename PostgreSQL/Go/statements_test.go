@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"example/sqlcheck"
+)
+
+// Every registered statement passes sqlcheck
+func TestStatementsCheck(t *testing.T) {
+	for _, s := range statements.statements {
+		if findings := sqlcheck.Check(s.SQL); len(findings) > 0 {
+			t.Errorf("%s: %v", s.Name, findings)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v4"
+)
+
+const defaultFetchSize = 1000
+
+var cursorSeq atomic.Int64
+
+// Streams a query through a server-side cursor inside a read-only
+// transaction, holding at most one FETCH batch in memory. Rows are fetched
+// only when the consumer asks for more, so a slow consumer slows the
+// stream instead of buffering the result set.
+//
+//	stream, err := streamOrders(ctx, 5000)
+//	defer stream.Close()
+//	for stream.Next() {
+//		order := stream.Value()
+//	}
+//	err = stream.Err()
+type cursorStream[T any] struct {
+	ctx       context.Context
+	tx        pgx.Tx
+	name      string
+	fetchSize int
+	scan      func(pgx.Rows) (T, error)
+
+	batch []T
+	pos   int
+	done  bool
+	err   error
+}
+
+func streamQuery[T any](ctx context.Context, fetchSize int, scan func(pgx.Rows) (T, error), query string, args ...interface{}) (*cursorStream[T], error) {
+	if fetchSize <= 0 {
+		fetchSize = defaultFetchSize
+	}
+	tx, err := pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, classifyError(ctx, opStream, err)
+	}
+	s := &cursorStream[T]{
+		ctx:       ctx,
+		tx:        tx,
+		name:      fmt.Sprintf("stream_%d", cursorSeq.Add(1)),
+		fetchSize: fetchSize,
+		scan:      scan,
+	}
+	err = applyServerTimeouts(ctx, tx, opStream)
+	if err == nil {
+		_, err = tx.Exec(ctx, fmt.Sprintf("DECLARE %s NO SCROLL CURSOR FOR %s", s.name, query), args...)
+	}
+	if err != nil {
+		tx.Rollback(context.Background())
+		return nil, classifyError(ctx, opStream, err)
+	}
+	return s, nil
+}
+
+// Advance to the next row, fetching the next batch when needed. It returns
+// false at the end of the result set or on error; the stream is then closed.
+func (s *cursorStream[T]) Next() bool {
+	if s.done {
+		return false
+	}
+	s.pos++
+	if s.pos < len(s.batch) {
+		return true
+	}
+	if err := s.fetch(); err != nil {
+		s.err = classifyError(s.ctx, opStream, err)
+		s.Close()
+		return false
+	}
+	if len(s.batch) == 0 {
+		s.Close()
+		return false
+	}
+	return true
+}
+
+func (s *cursorStream[T]) fetch() error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	rows, err := s.tx.Query(s.ctx, fmt.Sprintf("FETCH FORWARD %d FROM %s", s.fetchSize, s.name))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.batch = s.batch[:0]
+	s.pos = 0
+	for rows.Next() {
+		v, err := s.scan(rows)
+		if err != nil {
+			return err
+		}
+		s.batch = append(s.batch, v)
+	}
+	return rows.Err()
+}
+
+// The current row; valid after Next returns true
+func (s *cursorStream[T]) Value() T {
+	return s.batch[s.pos]
+}
+
+func (s *cursorStream[T]) Err() error {
+	return s.err
+}
+
+// Close ends the transaction, which also closes the cursor. It is safe to
+// call more than once and must be called when breaking out early.
+func (s *cursorStream[T]) Close() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.batch = nil
+	// Rollback must run even when ctx is already cancelled
+	s.tx.Rollback(context.Background())
+}
+
+func streamOrders(ctx context.Context, fetchSize int) (*cursorStream[Order], error) {
+	return streamQuery(ctx, fetchSize, func(rows pgx.Rows) (Order, error) {
+		var o Order
+		err := rows.Scan(&o.ID, &o.UserID, &o.Product, &o.Amount)
+		return o, err
+	}, "SELECT id, user_id, product, amount FROM orders ORDER BY id")
+}
+
+func streamUsers(ctx context.Context, fetchSize int, filter *userFilter) (*cursorStream[User], error) {
+	return streamQuery(ctx, fetchSize, func(rows pgx.Rows) (User, error) {
+		var u User
+		err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Age, &u.Attributes)
+		return u, err
+	}, "SELECT id, name, email, age, attributes FROM users "+filter.where()+" ORDER BY id", filter.args...)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// Operation classes with their default client deadline and the server-side
+// statement_timeout and lock_timeout applied with SET LOCAL. A zero server
+// timeout leaves the server setting alone; when both are zero the statement
+// runs outside a transaction, which VACUUM requires.
+type opClass struct {
+	name             string
+	deadline         time.Duration
+	statementTimeout time.Duration
+	lockTimeout      time.Duration
+}
+
+var (
+	opRead        = opClass{name: "read", deadline: 5 * time.Second, statementTimeout: 4 * time.Second, lockTimeout: time.Second}
+	opWrite       = opClass{name: "write", deadline: 10 * time.Second, statementTimeout: 8 * time.Second, lockTimeout: 2 * time.Second}
+	opSchema      = opClass{name: "schema", deadline: 30 * time.Second, lockTimeout: 5 * time.Second}
+	opBulk        = opClass{name: "bulk", deadline: 30 * time.Minute, lockTimeout: 5 * time.Second}
+	opMaintenance = opClass{name: "maintenance", deadline: 30 * time.Minute}
+	// Streams have no overall deadline. statement_timeout counts per
+	// statement, so it bounds the DECLARE and each FETCH, not the stream: an
+	// export of any length runs as long as every batch arrives within 30s.
+	// A FETCH that needs longer, e.g. for a sort before its first row, is
+	// cancelled with ErrStatementTimeout; use a smaller fetch size or an
+	// index that avoids the sort.
+	opStream = opClass{name: "stream", statementTimeout: 30 * time.Second, lockTimeout: time.Second}
+)
+
+func (op opClass) serverTimeouts() bool {
+	return op.statementTimeout > 0 || op.lockTimeout > 0
+}
+
+// Errors that distinguish why an operation did not complete
+var (
+	ErrCanceled         = errors.New("canceled by caller")
+	ErrTimeout          = errors.New("timed out")
+	ErrStatementTimeout = fmt.Errorf("statement_timeout exceeded: %w", ErrTimeout)
+	ErrLockTimeout      = fmt.Errorf("lock_timeout exceeded: %w", ErrTimeout)
+	ErrServerCanceled   = errors.New("canceled by server")
+)
+
+type OpError struct {
+	Op   string
+	Kind error
+	Err  error
+}
+
+func (e *OpError) Error() string {
+	return fmt.Sprintf("%s operation %v: %v", e.Op, e.Kind, e.Err)
+}
+
+func (e *OpError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// Wrap err in an OpError when it was caused by cancellation or a timeout.
+// ctx is the operation context, so its state tells client-side cancellation
+// apart from the server cancelling the statement (SQLSTATE 57014).
+func classifyError(ctx context.Context, op opClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	var opErr *OpError
+	if errors.As(err, &opErr) {
+		return err
+	}
+	var pgErr *pgconn.PgError
+	var kind error
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		kind = ErrCanceled
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		kind = ErrTimeout
+	case errors.As(err, &pgErr) && pgErr.Code == "57014" && strings.Contains(pgErr.Message, "statement timeout"):
+		kind = ErrStatementTimeout
+	case errors.As(err, &pgErr) && pgErr.Code == "57014":
+		kind = ErrServerCanceled
+	case errors.As(err, &pgErr) && pgErr.Code == "55P03":
+		kind = ErrLockTimeout
+	case pgconn.Timeout(err):
+		kind = ErrTimeout
+	default:
+		return err
+	}
+	return &OpError{Op: op.name, Kind: kind, Err: err}
+}
+
+// Equivalent to SET LOCAL, but parameterized
+func applyServerTimeouts(ctx context.Context, tx pgx.Tx, op opClass) error {
+	if op.statementTimeout > 0 {
+		_, err := tx.Exec(ctx, "SELECT set_config('statement_timeout', $1, true)", fmt.Sprint(op.statementTimeout.Milliseconds()))
+		if err != nil {
+			return err
+		}
+	}
+	if op.lockTimeout > 0 {
+		_, err := tx.Exec(ctx, "SELECT set_config('lock_timeout', $1, true)", fmt.Sprint(op.lockTimeout.Milliseconds()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rows that end the operation's transaction and deadline when closed
+type opRows struct {
+	pgx.Rows
+	ctx      context.Context
+	op       opClass
+	tx       pgx.Tx
+	cancel   context.CancelFunc
+	closeErr error
+}
+
+func (r *opRows) Close() {
+	if r.cancel == nil {
+		return
+	}
+	r.Rows.Close()
+	if r.tx != nil {
+		if r.Rows.Err() == nil {
+			r.closeErr = r.tx.Commit(r.ctx)
+		} else {
+			r.tx.Rollback(r.ctx)
+		}
+	}
+	r.cancel()
+	r.cancel = nil
+}
+
+func (r *opRows) Err() error {
+	if err := r.Rows.Err(); err != nil {
+		return classifyError(r.ctx, r.op, err)
+	}
+	return classifyError(r.ctx, r.op, r.closeErr)
+}
+
+// Utility function to execute queries. The rows must be closed.
+func executeQuery(ctx context.Context, op opClass, query string, params ...interface{}) (pgx.Rows, error) {
+	ctx, cancel := context.WithTimeout(ctx, op.deadline)
+	if !op.serverTimeouts() {
+		rows, err := pool.Query(ctx, query, params...)
+		if err != nil {
+			err = classifyError(ctx, op, err)
+			cancel()
+			return nil, err
+		}
+		return &opRows{Rows: rows, ctx: ctx, op: op, cancel: cancel}, nil
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		err = classifyError(ctx, op, err)
+		cancel()
+		return nil, err
+	}
+	if err = applyServerTimeouts(ctx, tx, op); err == nil {
+		var rows pgx.Rows
+		rows, err = tx.Query(ctx, query, params...)
+		if err == nil {
+			return &opRows{Rows: rows, ctx: ctx, op: op, tx: tx, cancel: cancel}, nil
+		}
+	}
+	tx.Rollback(ctx)
+	err = classifyError(ctx, op, err)
+	cancel()
+	return nil, err
+}
+
+// Utility function to execute statements that return no rows
+func executeExec(ctx context.Context, op opClass, query string, params ...interface{}) (pgconn.CommandTag, error) {
+	ctx, cancel := context.WithTimeout(ctx, op.deadline)
+	defer cancel()
+	if !op.serverTimeouts() {
+		tag, err := pool.Exec(ctx, query, params...)
+		return tag, classifyError(ctx, op, err)
+	}
+
+	var tag pgconn.CommandTag
+	err := executeTx(ctx, op, func(tx pgx.Tx) error {
+		var err error
+		tag, err = tx.Exec(ctx, query, params...)
+		return err
+	})
+	return tag, err
+}
+
+// Utility function to run fn in a transaction with the operation's timeouts.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+func executeTx(ctx context.Context, op opClass, fn func(pgx.Tx) error) error {
+	ctx, cancel := context.WithTimeout(ctx, op.deadline)
+	defer cancel()
+	err := pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if op.serverTimeouts() {
+			if err := applyServerTimeouts(ctx, tx, op); err != nil {
+				return err
+			}
+		}
+		return fn(tx)
+	})
+	return classifyError(ctx, op, err)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"example/sqlcheck"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// One traced statement. SQL is normalized: literals are replaced with ?
+// and parameter values are never recorded.
+type QueryEvent struct {
+	Kind         string // Query, Exec, CopyFrom or SendBatch
+	SQL          string
+	Duration     time.Duration
+	RowsAffected int64
+	Err          error
+}
+
+// Receives pgx's per-statement log calls, which pgx makes for every query
+// and exec on every pooled connection, including inside transactions.
+type queryTracer struct {
+	slowThreshold     time.Duration
+	explainSampleRate float64
+	slowLog           *slog.Logger
+	checkSQL          bool
+
+	mu sync.Mutex
+	// Normalized statements already run through sqlcheck
+	checked map[string]bool
+}
+
+var tracer *queryTracer
+
+// Captures in progress. They are kept apart from the tracer, so capturing
+// works before connect and sees statements from any tracer, including one
+// installed on a single connection in a test.
+var captures = struct {
+	sync.Mutex
+	active map[*queryCapture]struct{}
+}{active: map[*queryCapture]struct{}{}}
+
+func newQueryTracer(config PoolConfig) *queryTracer {
+	return &queryTracer{
+		slowThreshold:     config.SlowQueryThreshold,
+		explainSampleRate: config.ExplainSampleRate,
+		slowLog:           slog.New(slog.NewJSONHandler(os.Stderr, nil)),
+		checkSQL:          config.CheckSQL,
+		checked:           map[string]bool{},
+	}
+}
+
+// Install the tracer on every connection the pool creates
+func (t *queryTracer) install(config *pgxpool.Config) {
+	config.ConnConfig.Logger = t
+	config.ConnConfig.LogLevel = pgx.LogLevelInfo
+}
+
+func (t *queryTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	event, ok := queryEventFromLog(msg, data)
+	if !ok {
+		return
+	}
+
+	// Statements run by name are reported by their SQL
+	sql, _ := data["sql"].(string)
+	sql = statements.sqlFor(sql)
+	captures.Lock()
+	for c := range captures.active {
+		c.events = append(c.events, event)
+		c.findings = append(c.findings, sqlcheck.Check(sql)...)
+	}
+	captures.Unlock()
+
+	t.mu.Lock()
+	check := t.checkSQL && !t.checked[event.SQL] && !explaining(ctx)
+	if check {
+		t.checked[event.SQL] = true
+	}
+	t.mu.Unlock()
+
+	if check {
+		for _, f := range sqlcheck.Check(sql) {
+			t.slowLog.Warn("suspicious sql", slog.String("rule", string(f.Rule)), slog.String("message", f.Message), slog.String("sql", event.SQL))
+		}
+	}
+
+	if event.Duration < t.slowThreshold || explaining(ctx) {
+		return
+	}
+	attrs := []any{
+		slog.String("kind", event.Kind),
+		slog.String("sql", event.SQL),
+		slog.Duration("duration", event.Duration),
+		slog.Int64("rows", event.RowsAffected),
+	}
+	if event.Err != nil {
+		attrs = append(attrs, slog.String("err", event.Err.Error()))
+	}
+	if pid, ok := data["pid"].(uint32); ok {
+		attrs = append(attrs, slog.Any("pid", pid))
+	}
+	t.slowLog.Warn("slow query", attrs...)
+
+	args, _ := data["args"].([]interface{})
+	if t.explainSampleRate > 0 && rand.Float64() < t.explainSampleRate && explainable(sql) {
+		// The connection that logged is still busy, so explain on another one
+		go t.explain(sql, event.SQL, len(args) > 0)
+	}
+}
+
+func queryEventFromLog(msg string, data map[string]interface{}) (QueryEvent, bool) {
+	event := QueryEvent{Kind: msg}
+	switch msg {
+	case "Query", "Exec":
+		sql, _ := data["sql"].(string)
+		event.SQL = normalizeSQL(statements.sqlFor(sql))
+	case "CopyFrom":
+		table, _ := data["tableName"].(pgx.Identifier)
+		columns, _ := data["columnNames"].([]string)
+		event.SQL = "COPY " + table.Sanitize() + " (" + strings.Join(columns, ", ") + ") FROM STDIN"
+	case "SendBatch":
+		event.SQL = "batch"
+	default:
+		return event, false
+	}
+	event.Duration, _ = data["time"].(time.Duration)
+	event.Err, _ = data["err"].(error)
+	switch v := data["rowCount"].(type) {
+	case int:
+		event.RowsAffected = int64(v)
+	case int64:
+		event.RowsAffected = v
+	}
+	if tag, ok := data["commandTag"].(pgconn.CommandTag); ok {
+		event.RowsAffected = tag.RowsAffected()
+	}
+	return event, true
+}
+
+type explainKey struct{}
+
+func explaining(ctx context.Context) bool {
+	return ctx.Value(explainKey{}) != nil
+}
+
+func explainable(sql string) bool {
+	word := strings.ToUpper(strings.SplitN(strings.TrimSpace(sql), " ", 2)[0])
+	switch word {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "WITH":
+		return true
+	}
+	return false
+}
+
+// EXPLAIN (without ANALYZE, so nothing runs) a slow statement. Parameter
+// values are not kept, so parameterized statements need GENERIC_PLAN,
+// available from PostgreSQL 16; on older servers only statements without
+// parameters are explained.
+func (t *queryTracer) explain(sql, normalized string, parameterized bool) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), explainKey{}, true), 5*time.Second)
+	defer cancel()
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		t.slowLog.Info("slow query explain failed", slog.String("sql", normalized), slog.String("err", err.Error()))
+		return
+	}
+	defer conn.Release()
+
+	explain := "EXPLAIN "
+	if parameterized {
+		if !supportsGenericPlan(conn.Conn().PgConn()) {
+			t.slowLog.Info("slow query not explained: parameterized statements need PostgreSQL 16", slog.String("sql", normalized))
+			return
+		}
+		explain = "EXPLAIN (GENERIC_PLAN) "
+	}
+	rows, err := conn.Query(ctx, explain+sql)
+	if err != nil {
+		t.slowLog.Info("slow query explain failed", slog.String("sql", normalized), slog.String("err", err.Error()))
+		return
+	}
+	defer rows.Close()
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return
+		}
+		plan = append(plan, line)
+	}
+	if err := rows.Err(); err != nil {
+		t.slowLog.Info("slow query explain failed", slog.String("sql", normalized), slog.String("err", err.Error()))
+		return
+	}
+	t.slowLog.Info("slow query plan", slog.String("sql", normalized), slog.String("plan", strings.Join(plan, "\n")))
+}
+
+// EXPLAIN (GENERIC_PLAN) is available from PostgreSQL 16
+func supportsGenericPlan(conn *pgconn.PgConn) bool {
+	major, _, _ := strings.Cut(conn.ParameterStatus("server_version"), ".")
+	n, err := strconv.Atoi(major)
+	return err == nil && n >= 16
+}
+
+// Records statements traced between captureQueries and Stop, so tests can
+// assert on the SQL an operation sends:
+//
+//	capture := captureQueries()
+//	createUser(ctx, "Eve", "eve@example.com", 22)
+//	events := capture.Stop()
+//	if findings := capture.Findings(); len(findings) > 0 { ... }
+type queryCapture struct {
+	events   []QueryEvent
+	findings []sqlcheck.Finding
+}
+
+// Start capturing. It does not need connect: statements logged by any
+// queryTracer are recorded.
+func captureQueries() *queryCapture {
+	c := &queryCapture{}
+	captures.Lock()
+	captures.active[c] = struct{}{}
+	captures.Unlock()
+	return c
+}
+
+// Stop capturing and return the captured statements
+func (c *queryCapture) Stop() []QueryEvent {
+	captures.Lock()
+	defer captures.Unlock()
+	delete(captures.active, c)
+	return c.events
+}
+
+// The captured statements whose normalized SQL contains substr
+func (c *queryCapture) Matching(substr string) []QueryEvent {
+	captures.Lock()
+	defer captures.Unlock()
+	var matched []QueryEvent
+	for _, e := range c.events {
+		if strings.Contains(e.SQL, substr) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
+
+// Normalize SQL for grouping and logging: comments are removed, string and
+// numeric literals become ?, lists of literals collapse to (?), and
+// whitespace collapses to single spaces. $n placeholders are kept.
+func normalizeSQL(sql string) string {
+	var b strings.Builder
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	isIdent := func(c byte) bool {
+		return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+			i++
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			space = true
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 4
+			}
+			space = true
+		case c == '\'' || (c == 'E' || c == 'e') && i+1 < len(sql) && sql[i+1] == '\'' && (i == 0 || !isIdent(sql[i-1])):
+			if c != '\'' {
+				i++
+			}
+			for i++; i < len(sql); i++ {
+				if sql[i] == '\\' && c != '\'' {
+					i++
+				} else if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+			}
+			i++
+			emit("?")
+		case c >= '0' && c <= '9' && (i == 0 || !isIdent(sql[i-1])):
+			for i < len(sql) && (sql[i] >= '0' && sql[i] <= '9' || sql[i] == '.') {
+				i++
+			}
+			emit("?")
+		case isIdent(c):
+			start := i
+			for i < len(sql) && isIdent(sql[i]) {
+				i++
+			}
+			emit(sql[start:i])
+		default:
+			emit(string(c))
+			i++
+		}
+	}
+	return collapseLiteralLists(b.String())
+}
+
+var literalList = regexp.MustCompile(`\?(\s*,\s*\?)+`)
+
+// Turn "(?, ?, ?)" into "(?)" so IN lists of any length normalize alike
+func collapseLiteralLists(sql string) string {
+	return literalList.ReplaceAllString(sql, "?")
+}
+
+// sqlcheck findings for the captured statements, checked before
+// normalization so literal predicates are still visible
+func (c *queryCapture) Findings() []sqlcheck.Finding {
+	captures.Lock()
+	defer captures.Unlock()
+	return c.findings
+}
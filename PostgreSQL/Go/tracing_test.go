@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"example/sqlcheck"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestCaptureQueries(t *testing.T) {
+	ctx := context.Background()
+	tr := newQueryTracer(PoolConfig{SlowQueryThreshold: time.Hour})
+
+	tr.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{"sql": "SELECT before FROM capture"})
+	capture := captureQueries()
+	// The data pgx logs for a query, an exec and a named statement
+	tr.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{
+		"sql":      "SELECT id FROM users WHERE name = 'Alice' AND age IN (1, 2, 3)",
+		"time":     3 * time.Millisecond,
+		"rowCount": 2,
+	})
+	tr.Log(ctx, pgx.LogLevelInfo, "Exec", map[string]interface{}{
+		"sql":        "UPDATE users SET age = 1, age = 2 WHERE id = $1",
+		"args":       []interface{}{7},
+		"commandTag": pgconn.CommandTag("UPDATE 1"),
+	})
+	tr.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{"sql": stmtDeleteUser.Name})
+	// Not a statement
+	tr.Log(ctx, pgx.LogLevelInfo, "Dialing PostgreSQL server", map[string]interface{}{"host": "localhost"})
+	events := capture.Stop()
+	tr.Log(ctx, pgx.LogLevelInfo, "Query", map[string]interface{}{"sql": "SELECT after FROM capture"})
+
+	want := []QueryEvent{
+		{Kind: "Query", SQL: "SELECT id FROM users WHERE name = ? AND age IN (?)", Duration: 3 * time.Millisecond, RowsAffected: 2},
+		{Kind: "Exec", SQL: "UPDATE users SET age = ?, age = ? WHERE id = $1", RowsAffected: 1},
+		{Kind: "Query", SQL: "DELETE FROM users WHERE id = $1 RETURNING id"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("captured %d statements, want %d: %+v", len(events), len(want), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("statement %d = %+v, want %+v", i, events[i], want[i])
+		}
+	}
+
+	if got := capture.Matching("UPDATE users"); len(got) != 1 {
+		t.Errorf("Matching(UPDATE users) = %+v, want one statement", got)
+	}
+	findings := capture.Findings()
+	if len(findings) != 1 || findings[0].Rule != sqlcheck.DuplicateSet {
+		t.Errorf("Findings() = %v, want one %s", findings, sqlcheck.DuplicateSet)
+	}
+}
+
+// Capture what a real connection sends, with the tracer installed on that
+// connection alone; skipped unless PG_TEST_DSN is set
+func TestCaptureQueriesConn(t *testing.T) {
+	dsn := os.Getenv("PG_TEST_DSN")
+	if dsn == "" {
+		t.Skip("PG_TEST_DSN not set")
+	}
+	ctx := context.Background()
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Logger = newQueryTracer(PoolConfig{SlowQueryThreshold: time.Hour})
+	config.LogLevel = pgx.LogLevelInfo
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer conn.Close(ctx)
+
+	capture := captureQueries()
+	var n int
+	if err := conn.QueryRow(ctx, "SELECT $1::int + 1", 41).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Exec(ctx, "SELECT 'x' WHERE 1 = 2"); err != nil {
+		t.Fatal(err)
+	}
+	events := capture.Stop()
+
+	if len(events) != 2 || events[0].SQL != "SELECT $1::int + ?" || events[1].SQL != "SELECT ? WHERE ? = ?" {
+		t.Fatalf("captured %+v", events)
+	}
+	if events[0].Err != nil || events[1].Err != nil {
+		t.Errorf("captured errors: %v, %v", events[0].Err, events[1].Err)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Free-form profile fields stored in users.attributes (JSONB)
+type Attributes map[string]interface{}
+
+type User struct {
+	ID         int
+	Name       string
+	Email      string
+	Age        int
+	Attributes Attributes
+}
+
+// Builds the WHERE clause for user queries. Each method appends one
+// predicate; predicates are combined with AND.
+type userFilter struct {
+	conds []string
+	args  []interface{}
+}
+
+func newUserFilter() *userFilter {
+	return &userFilter{}
+}
+
+func (f *userFilter) arg(v interface{}) string {
+	f.args = append(f.args, v)
+	return fmt.Sprintf("$%d", len(f.args))
+}
+
+func (f *userFilter) AgeBetween(min, max int) *userFilter {
+	f.conds = append(f.conds, fmt.Sprintf("age BETWEEN %s AND %s", f.arg(min), f.arg(max)))
+	return f
+}
+
+func (f *userFilter) NameIn(names ...string) *userFilter {
+	f.conds = append(f.conds, fmt.Sprintf("name = ANY(%s)", f.arg(names)))
+	return f
+}
+
+// attributes @> value; value may be a map or any struct that marshals to a
+// JSON object. Served by the GIN index on attributes.
+func (f *userFilter) AttributesContain(value interface{}) *userFilter {
+	f.conds = append(f.conds, fmt.Sprintf("attributes @> %s", f.arg(value)))
+	return f
+}
+
+// The attribute at path equals value. Expressed as containment of
+// {"a": {"b": value}} so the GIN index is still used.
+func (f *userFilter) AttributeEquals(path []string, value interface{}) *userFilter {
+	for i := len(path) - 1; i >= 0; i-- {
+		value = map[string]interface{}{path[i]: value}
+	}
+	return f.AttributesContain(value)
+}
+
+// The attribute at path exists, whatever its value
+func (f *userFilter) AttributeExists(path []string) *userFilter {
+	f.conds = append(f.conds, fmt.Sprintf("attributes #> %s IS NOT NULL", f.arg(path)))
+	return f
+}
+
+// A SQL/JSON path predicate, e.g. `$.preferences.notifications == true`
+// or `$.tags[*] == "beta"`. Served by the GIN index on attributes.
+func (f *userFilter) AttributesMatch(jsonPath string) *userFilter {
+	f.conds = append(f.conds, fmt.Sprintf("attributes @@ %s::jsonpath", f.arg(jsonPath)))
+	return f
+}
+
+func (f *userFilter) where() string {
+	if len(f.conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.conds, " AND ")
+}
+
+// Repository functions for users
+func findUsers(ctx context.Context, filter *userFilter) ([]User, error) {
+	query := "SELECT id, name, email, age, attributes FROM users " + filter.where() + " ORDER BY id"
+	rows, err := executeQuery(ctx, opRead, query, filter.args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &u.Email, &u.Age, &u.Attributes); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Decode a user's attributes into dst, which may be a *Attributes or a
+// pointer to a struct with json tags
+func getUserAttributes(ctx context.Context, id int, dst interface{}) error {
+	rows, err := executeQuery(ctx, opRead, "SELECT attributes FROM users WHERE id = $1", id)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return pgx.ErrNoRows
+	}
+	if err := rows.Scan(dst); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// Set one attribute with jsonb_set, leaving the rest untouched. Missing
+// parent objects along path are created first, because jsonb_set only
+// creates the last key; each level is a LATERAL step over the previous
+// one, so the statement grows linearly with the depth of path.
+func setUserAttribute(ctx context.Context, id int, path []string, value interface{}) error {
+	if len(path) == 0 {
+		return errors.New("attribute path is empty")
+	}
+	// pgx sends strings to jsonb parameters as JSON text, so encode first
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{id, path, string(encoded)}
+	var from strings.Builder
+	from.WriteString("(SELECT attributes AS a0) s0")
+	for i := 1; i < len(path); i++ {
+		args = append(args, path[:i])
+		fmt.Fprintf(&from, ", LATERAL (SELECT jsonb_set(a%[1]d, $%[3]d, COALESCE(a%[1]d #> $%[3]d, '{}')) AS a%[2]d) s%[2]d",
+			i-1, i, len(args))
+	}
+	query := fmt.Sprintf("UPDATE users SET attributes = (SELECT jsonb_set(a%d, $2, $3) FROM %s) WHERE id = $1",
+		len(path)-1, from.String())
+
+	tag, err := executeExec(ctx, opWrite, query, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Merge keys into a user's attributes with ||
+func mergeUserAttributes(ctx context.Context, id int, attrs interface{}) error {
+	tag, err := executeExec(ctx, opWrite, "UPDATE users SET attributes = attributes || $2 WHERE id = $1", id, attrs)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// Remove the attribute at path with #-
+func deleteUserAttribute(ctx context.Context, id int, path []string) error {
+	tag, err := executeExec(ctx, opWrite, "UPDATE users SET attributes = attributes #- $2 WHERE id = $1", id, path)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}